@@ -1,11 +1,11 @@
 package centrifuge
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"math/rand"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,9 +16,14 @@ import (
 
 type Centrifuge interface {
 	Connect() error
+	ConnectContext(context.Context) error
 	Reconnect(ReconnectStrategy) error
 	Subscribe(string, *SubEventHandler) (*Sub, error)
+	SubscribeContext(context.Context, string, *SubEventHandler) (*Sub, error)
+	SubscribeMany(map[string]*SubEventHandler) map[string]SubscribeResult
+	SubscribeManyContext(context.Context, map[string]*SubEventHandler) map[string]SubscribeResult
 	ClientID() string
+	Status() Status
 	Close()
 }
 
@@ -48,12 +53,14 @@ var (
 	ErrBadUnsubscribeStatus  = errors.New("bad unsubscribe status")
 	ErrBadPublishStatus      = errors.New("bad publish status")
 	ErrUnexpectedMessageData = errors.New("unexpected message data")
+	ErrBinaryNotSupported    = errors.New("connection does not support binary frames")
 )
 
 const (
 	DefaultPrivateChannelPrefix = "$"
 	DefaultTimeout              = 1 * time.Second
 	DefaultReconnect            = true
+	DefaultMaxPublishInFlight   = 256
 )
 
 // Config contains various client options.
@@ -62,6 +69,78 @@ type Config struct {
 	PrivateChannelPrefix string
 	Debug                bool
 	Reconnect            bool
+
+	// Logger receives client diagnostics, nil discards them. Debug level
+	// entries are only passed through when Debug is set.
+	Logger Logger
+
+	// MaxPublishInFlight limits number of PublishAsync calls waiting for
+	// server reply, DefaultMaxPublishInFlight is used when not set.
+	MaxPublishInFlight int
+
+	// WriteBatchSize is maximum number of queued frames coalesced into one
+	// frame. It counts frames rather than commands: frame of SubscribeMany
+	// holds all its subscribe commands and counts once. Values below 2
+	// disable batching.
+	WriteBatchSize int
+	// WriteBatchWindow is how long to wait for more frames after first one
+	// was queued. Zero only coalesces frames which are already queued.
+	WriteBatchWindow time.Duration
+
+	// ReconnectStrategy makes client reconnect and resubscribe on its own
+	// when connection lost. Do not call Reconnect from OnDisconnect when it
+	// is set.
+	ReconnectStrategy ReconnectStrategy
+
+	// SubBufferSize is capacity of Sub.Messages and Sub.Events channels,
+	// DefaultSubBufferSize is used when not set. SubOverflowPolicy applies
+	// when consumer does not keep up, OverflowBlock by default.
+	SubBufferSize     int
+	SubOverflowPolicy OverflowPolicy
+
+	// DispatchQueueSize limits messages, join and leave events waiting for
+	// handlers of one subscription, DefaultDispatchQueueSize is used when
+	// not set. Handlers run on goroutine of subscription, so slow one does
+	// not delay other subscriptions and replies. DispatchOverflowPolicy
+	// applies when queue is full, OverflowDisconnect by default so missed
+	// messages are recovered after reconnect. OverflowBlock is not
+	// supported, waiting would stop replies and pings, it means
+	// OverflowDisconnect too.
+	DispatchQueueSize      int
+	DispatchOverflowPolicy OverflowPolicy
+
+	// HandlerErrorPolicy applies when OnMessage, OnJoin, OnLeave or
+	// OnUnsubscribe returns error, HandlerErrorLog by default.
+	// HandlerRetries and HandlerRetryDelay are used by HandlerErrorRetry,
+	// DefaultHandlerRetries and DefaultHandlerRetryDelay when not set.
+	HandlerErrorPolicy HandlerErrorPolicy
+	HandlerRetries     int
+	HandlerRetryDelay  time.Duration
+
+	// PingInterval is how often client sends ping command to server.
+	// Connection is considered dead and dropped when reply not received
+	// during Timeout. Zero disables pings.
+	PingInterval time.Duration
+
+	// ConnectionFactory creates connections to server, NewWSConnection is
+	// used when not set. It is called with context passed to ConnectContext.
+	ConnectionFactory ConnectionFactory
+
+	// PrivateSignProvider signs private channels in batches when
+	// SubEventHandler.OnPrivateSub is not set. Signs are cached until
+	// client ID changes.
+	PrivateSignProvider PrivateSignProvider
+
+	// Codec encodes commands and decodes replies, JSONCodec is used when
+	// not set. Binary codecs need connection implementing BinaryConnection.
+	Codec Codec
+
+	// Metrics receives measurements of commands, queues, reconnects,
+	// refreshes and messages when set.
+	Metrics Metrics
+
+	// Tracer traces commands sent to server when set.
+	Tracer Tracer
 }
 
 // DefaultConfig with standard private channel prefix and 1 second timeout.
@@ -77,6 +156,7 @@ type clientCommand struct {
 	Params interface{} `json:"params"`
 }
 
+// response Body is left encoded, it is decoded with Config.Codec.
 type response struct {
 	UID    string          `json:"uid,omitempty"`
 	Error  string          `json:"error"`
@@ -113,12 +193,24 @@ type DisconnectHandler func(Centrifuge) error
 // ErrorHandler is a function to handle critical protocol errors manually.
 type ErrorHandler func(Centrifuge, error)
 
+// ReconnectHandler is a function to handle reconnect events. OnReconnecting
+// is called before reconnect attempts start, OnReconnected when connection
+// restored and all channels resubscribed.
+type ReconnectHandler func(Centrifuge)
+
+// StateChangeHandler is a function to handle connection status changes. It is
+// called from separate goroutine, changes are reported in order.
+type StateChangeHandler func(c Centrifuge, oldStatus, newStatus Status)
+
 // EventHandler contains callback functions that will be called when
 // corresponding event happens with connection to Centrifuge.
 type EventHandler struct {
-	OnDisconnect DisconnectHandler
-	OnRefresh    RefreshHandler
-	OnError      ErrorHandler
+	OnDisconnect   DisconnectHandler
+	OnRefresh      RefreshHandler
+	OnError        ErrorHandler
+	OnStateChange  StateChangeHandler
+	OnReconnecting ReconnectHandler
+	OnReconnected  ReconnectHandler
 }
 
 func DefaultBackoffReconnector(c Centrifuge) error {
@@ -130,14 +222,7 @@ func DefaultPeriodicReconnector(c Centrifuge) error {
 }
 
 func defaultReconnector(c Centrifuge, s ReconnectStrategy) error {
-	log.Print("defaultReconnector: reconnecting...")
-	err := c.Reconnect(s)
-	if err != nil {
-		log.Print("defaultReconnector: ", err)
-	} else {
-		log.Print("defaultReconnector: reconnected")
-	}
-	return err
+	return c.Reconnect(s)
 }
 
 // Status shows actual connection status.
@@ -151,6 +236,29 @@ const (
 	RECONNECTING
 )
 
+// String returns lowercase status name.
+func (s Status) String() string {
+	switch s {
+	case DISCONNECTED:
+		return "disconnected"
+	case CONNECTED:
+		return "connected"
+	case CLOSING:
+		return "closing"
+	case CLOSED:
+		return "closed"
+	case RECONNECTING:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+type statusChange struct {
+	oldStatus Status
+	newStatus Status
+}
+
 // Centrifuge describes client connection to Centrifugo server.
 type centrifugeImpl struct {
 	mutex        sync.RWMutex
@@ -167,16 +275,30 @@ type centrifugeImpl struct {
 	waiters      map[string]chan response
 	receive      chan []byte
 	write        chan []byte
-	closed       chan struct{}
-	events       *EventHandler
-	reconnect    bool
+	// closed is replaced under mutex and closedMutex, callers which do not
+	// hold mutex read it with closedChan.
+	closed      chan struct{}
+	closedMutex sync.RWMutex
+	events      *EventHandler
+	// noReconnect is set when server forbids reconnect, it is atomic as
+	// disconnect message is handled on run goroutine which must not lock.
+	noReconnect atomic.Bool
 
 	project          libcentrifugo.ProjectKey
 	wgworkers        sync.WaitGroup
 	createConnection ConnectionFactory
+	signs            signCache
+
+	publishOnce     sync.Once
+	publishInFlight chan struct{}
+
+	statusChangesMutex sync.Mutex
+	statusChanges      []statusChange
+	notifyMutex        sync.Mutex
 }
 
-// MessageHandler is a function to handle messages in channels.
+// MessageHandler is a function to handle messages in channels. Returned
+// error is handled according to Config.HandlerErrorPolicy.
 type MessageHandler func(*Sub, libcentrifugo.Message) error
 
 // JoinHandler is a function to handle join messages.
@@ -185,17 +307,93 @@ type JoinHandler func(*Sub, libcentrifugo.ClientInfo) error
 // LeaveHandler is a function to handle leave messages.
 type LeaveHandler func(*Sub, libcentrifugo.ClientInfo) error
 
-// UnsubscribeHandler is a function to handle unsubscribe event.
-type UnsubscribeHandler func(*Sub) error
+// UnsubscribeReason tells why subscription ended.
+type UnsubscribeReason int
+
+const (
+	// UnsubscribeClient means Sub.Unsubscribe was called.
+	UnsubscribeClient = UnsubscribeReason(iota)
+	// UnsubscribeServer means server unsubscribed client from channel.
+	UnsubscribeServer
+	// UnsubscribeClose means client was closed.
+	UnsubscribeClose
+)
+
+// String returns lowercase reason name.
+func (r UnsubscribeReason) String() string {
+	switch r {
+	case UnsubscribeClient:
+		return "client"
+	case UnsubscribeServer:
+		return "server"
+	case UnsubscribeClose:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+// UnsubscribeHandler is a function to handle unsubscribe event. It is
+// called once per subscription, after Sub was removed from client.
+type UnsubscribeHandler func(*Sub, UnsubscribeReason) error
+
+// RecoveredHandler is called after resubscribe when client tried to recover
+// messages missed while it was disconnected. recovered is false when server
+// history was too short to return all missed messages.
+type RecoveredHandler func(sub *Sub, recovered bool) error
+
+// SubscribeSuccessHandler is called every time channel was subscribed,
+// including resubscribe after reconnect. It runs with other handlers of
+// subscription, so it may call client methods, e.g. Sub.Resubscribe.
+type SubscribeSuccessHandler func(*Sub) error
+
+// SubscribeErrorHandler is called when subscribe failed, e.g. server
+// returned error or OnPrivateSub could not sign private channel. Like
+// SubscribeSuccessHandler it may call client methods.
+type SubscribeErrorHandler func(*Sub, error) error
 
 // SubEventHandler contains callback functions that will be called when
 // corresponding event happens with subscription to channel.
 type SubEventHandler struct {
-	OnMessage     MessageHandler
-	OnJoin        JoinHandler
-	OnLeave       LeaveHandler
-	OnUnsubscribe UnsubscribeHandler
-	OnPrivateSub  PrivateSubHandler
+	OnMessage          MessageHandler
+	OnJoin             JoinHandler
+	OnLeave            LeaveHandler
+	OnUnsubscribe      UnsubscribeHandler
+	OnPrivateSub       PrivateSubHandler
+	OnRecovered        RecoveredHandler
+	OnSubscribeSuccess SubscribeSuccessHandler
+	OnSubscribeError   SubscribeErrorHandler
+}
+
+// SubState is a state of subscription.
+type SubState int
+
+const (
+	// SubUnsubscribed is a state of new Sub and Sub removed from client.
+	SubUnsubscribed = SubState(iota)
+	// SubSubscribing means subscribe request is in flight or Sub waits
+	// for reconnect to be resubscribed.
+	SubSubscribing
+	SubSubscribed
+	// SubFailed means last subscribe attempt failed. Sub stays in client
+	// and is retried on reconnect or with Sub.Resubscribe.
+	SubFailed
+)
+
+// String returns lowercase state name.
+func (s SubState) String() string {
+	switch s {
+	case SubUnsubscribed:
+		return "unsubscribed"
+	case SubSubscribing:
+		return "subscribing"
+	case SubSubscribed:
+		return "subscribed"
+	case SubFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
 }
 
 // Sub represents subscription on channel.
@@ -203,84 +401,313 @@ type Sub struct {
 	centrifuge    *centrifugeImpl
 	Channel       string
 	events        *SubEventHandler
-	lastMessageID *libcentrifugo.MessageID // unused in this version
 	privateSign   *PrivateSign
+	mutex         sync.Mutex
+	lastMessageID *libcentrifugo.MessageID
+	recovering    bool
+	pending       []libcentrifugo.Message
+	state         SubState
+	err           error
+	channels      subChannels
+	dispatcher    dispatcher
+}
+
+// SubscribeResult is an outcome of subscription on one channel made with
+// SubscribeMany. Sub is nil when Err is not nil.
+type SubscribeResult struct {
+	Sub *Sub
+	Err error
 }
 
-func (c *centrifugeImpl) newSub(channel string, events *SubEventHandler) (*Sub, error) {
-	sub := &Sub{
+func (c *centrifugeImpl) newSub(channel string, events *SubEventHandler) *Sub {
+	return &Sub{
 		centrifuge: c,
 		Channel:    channel,
 		events:     events,
 	}
-	err := sub.initPrivateSign()
-	return sub, err
 }
 
 // Publish JSON encoded data.
 func (s *Sub) Publish(data []byte) error {
-	return s.centrifuge.publish(s.Channel, data)
+	return s.PublishContext(context.Background(), data)
+}
+
+// PublishContext publishes JSON encoded data and returns ctx.Err() if ctx
+// is done before server replied.
+func (s *Sub) PublishContext(ctx context.Context, data []byte) error {
+	return s.centrifuge.publish(ctx, s.Channel, data)
+}
+
+// PublishAsync sends JSON encoded data without waiting for server reply.
+// done, if not nil, is always called from separate goroutine with publish
+// result, ErrClientDisconnected when client is not connected.
+// Publishes are sent in order of PublishAsync calls. When
+// Config.MaxPublishInFlight publishes are waiting for reply PublishAsync
+// blocks until one of them completes.
+func (s *Sub) PublishAsync(data []byte, done func(error)) {
+	s.centrifuge.publishAsync(s.Channel, data, done)
 }
 
 // History allows to extract channel history.
 func (s *Sub) History() ([]libcentrifugo.Message, error) {
-	return s.centrifuge.history(s.Channel)
+	return s.HistoryContext(context.Background())
+}
+
+// HistoryContext is like History but respects ctx cancellation.
+func (s *Sub) HistoryContext(ctx context.Context) ([]libcentrifugo.Message, error) {
+	return s.centrifuge.history(ctx, s.Channel)
 }
 
 // Presence allows to extract presence information for channel.
 func (s *Sub) Presence() (map[libcentrifugo.ConnID]libcentrifugo.ClientInfo, error) {
-	return s.centrifuge.presence(s.Channel)
+	return s.PresenceContext(context.Background())
+}
+
+// PresenceContext is like Presence but respects ctx cancellation.
+func (s *Sub) PresenceContext(ctx context.Context) (map[libcentrifugo.ConnID]libcentrifugo.ClientInfo, error) {
+	return s.centrifuge.presence(ctx, s.Channel)
+}
+
+// State returns actual subscription state.
+func (s *Sub) State() SubState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+// Err returns error of last subscribe attempt when State is SubFailed.
+func (s *Sub) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+func (s *Sub) setState(state SubState, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = state
+	s.err = err
+}
+
+// Resubscribe retries subscribe of Sub in SubFailed state.
+func (s *Sub) Resubscribe() error {
+	return s.ResubscribeContext(context.Background())
+}
+
+// ResubscribeContext is like Resubscribe but respects ctx cancellation.
+func (s *Sub) ResubscribeContext(ctx context.Context) error {
+	return s.centrifuge.resubscribeSub(ctx, s)
 }
 
 // Unsubscribe allows to unsubscribe from channel.
 func (s *Sub) Unsubscribe() error {
-	return s.centrifuge.unsubscribe(s.Channel)
+	return s.UnsubscribeContext(context.Background())
+}
+
+// UnsubscribeContext is like Unsubscribe but respects ctx cancellation.
+func (s *Sub) UnsubscribeContext(ctx context.Context) error {
+	return s.centrifuge.unsubscribe(ctx, s)
 }
 
 func (s *Sub) handleMessage(m libcentrifugo.Message) {
+	s.mutex.Lock()
+	if s.recovering {
+		// Hold live messages back until missed ones are replayed.
+		s.pending = append(s.pending, m)
+		s.mutex.Unlock()
+		return
+	}
+	s.mutex.Unlock()
+	targets := s.targets()
+	s.dispatch(func() { s.deliverMessage(m, targets) }, true)
+}
+
+func (s *Sub) deliverMessage(m libcentrifugo.Message, targets subTargets) {
 	var onMessage MessageHandler
 	if s.events != nil && s.events.OnMessage != nil {
 		onMessage = s.events.OnMessage
 	}
+	if !s.sendMessage(m, targets) {
+		// Dropped to be recovered after reconnect.
+		return
+	}
 	mid := libcentrifugo.MessageID(m.UID)
+	s.mutex.Lock()
 	s.lastMessageID = &mid
+	s.mutex.Unlock()
+	if s.centrifuge != nil {
+		s.centrifuge.observeMessage(s.Channel)
+	}
 	if onMessage != nil {
-		onMessage(s, m)
+		s.handle(SubEventMessage, func() error { return onMessage(s, m) })
 	}
 }
 
 func (s *Sub) handleJoinMessage(info libcentrifugo.ClientInfo) {
-	var onJoin JoinHandler
-	if s.events != nil && s.events.OnJoin != nil {
-		onJoin = s.events.OnJoin
-	}
-	if onJoin != nil {
-		onJoin(s, info)
-	}
+	targets := s.targets()
+	s.dispatch(func() {
+		var onJoin JoinHandler
+		if s.events != nil && s.events.OnJoin != nil {
+			onJoin = s.events.OnJoin
+		}
+		if onJoin != nil {
+			s.handle(SubEventJoin, func() error { return onJoin(s, info) })
+		}
+		s.sendEvent(SubEvent{Type: SubEventJoin, Info: info}, targets)
+	}, true)
 }
 
 func (s *Sub) handleLeaveMessage(info libcentrifugo.ClientInfo) {
-	var onLeave LeaveHandler
-	if s.events != nil && s.events.OnLeave != nil {
-		onLeave = s.events.OnLeave
-	}
-	if onLeave != nil {
-		onLeave(s, info)
-	}
+	targets := s.targets()
+	s.dispatch(func() {
+		var onLeave LeaveHandler
+		if s.events != nil && s.events.OnLeave != nil {
+			onLeave = s.events.OnLeave
+		}
+		if onLeave != nil {
+			s.handle(SubEventLeave, func() error { return onLeave(s, info) })
+		}
+		s.sendEvent(SubEvent{Type: SubEventLeave, Info: info}, targets)
+	}, true)
+}
+
+// unsubscribed closes channels and calls OnUnsubscribe after events queued
+// before. Sub must be removed from client with removeSub before.
+func (s *Sub) unsubscribed(reason UnsubscribeReason) {
+	s.setState(SubUnsubscribed, nil)
+	s.dispatch(func() {
+		s.closeChannels(reason)
+		var onUnsubscribe UnsubscribeHandler
+		if s.events != nil && s.events.OnUnsubscribe != nil {
+			onUnsubscribe = s.events.OnUnsubscribe
+		}
+		if onUnsubscribe != nil {
+			s.handle(SubEventUnsubscribe, func() error { return onUnsubscribe(s, reason) })
+		}
+	}, false)
+}
+
+// subscribeParams signs private channel and builds subscribe command. When
+// sub already received messages it asks server to recover missed ones and
+// holds live messages back until subscribed is called.
+func (s *Sub) subscribeParams() (*libcentrifugo.SubscribeClientCommand, *libcentrifugo.MessageID) {
+	s.mutex.Lock()
+	lastMessageID := s.lastMessageID
+	s.recovering = lastMessageID != nil
+	s.mutex.Unlock()
+	s.resetOverflow()
+
+	return s.centrifuge.subscribeParams(s.Channel, lastMessageID, s.privateSign), lastMessageID
 }
 
-func (s *Sub) resubscribe() error {
-	err := s.initPrivateSign()
+// subscribed handles subscribe reply to command built by subscribeParams.
+func (s *Sub) subscribed(lastMessageID *libcentrifugo.MessageID, body libcentrifugo.SubscribeBody, err error) {
 	if err != nil {
-		return err
+		s.dispatch(func() { s.recover(nil, nil) }, false)
+		s.subscribeFailed(err)
+		return
 	}
-	_, err = s.centrifuge.sendSubscribe(s.Channel, s.lastMessageID, s.privateSign)
-	if err != nil {
-		return err
+
+	if lastMessageID == nil {
+		// Recover from last message in channel even when none was
+		// received before connection is lost.
+		s.mutex.Lock()
+		if s.lastMessageID == nil {
+			last := body.Last
+			s.lastMessageID = &last
+		}
+		s.mutex.Unlock()
 	}
 
-	// resubscribe successfull.
-	return nil
+	s.setState(SubSubscribed, nil)
+	var onSubscribeSuccess SubscribeSuccessHandler
+	if s.events != nil && s.events.OnSubscribeSuccess != nil {
+		onSubscribeSuccess = s.events.OnSubscribeSuccess
+	}
+	if onSubscribeSuccess != nil {
+		// Not called inline, caller may hold client lock during reconnect.
+		s.dispatch(func() {
+			s.handle(SubEventSubscribeSuccess, func() error { return onSubscribeSuccess(s) })
+		}, false)
+	}
+
+	if lastMessageID != nil {
+		s.dispatch(func() {
+			s.recover(lastMessageID, body.Messages)
+			var onRecovered RecoveredHandler
+			if s.events != nil && s.events.OnRecovered != nil {
+				onRecovered = s.events.OnRecovered
+			}
+			if onRecovered != nil {
+				s.handle(SubEventRecovered, func() error { return onRecovered(s, body.Recovered) })
+			}
+		}, false)
+	}
+}
+
+func (s *Sub) subscribeFailed(err error) {
+	s.setState(SubFailed, err)
+	s.centrifuge.log(LogLevelWarn, "subscribe failed", "channel", s.Channel, "error", err)
+	var onSubscribeError SubscribeErrorHandler
+	if s.events != nil && s.events.OnSubscribeError != nil {
+		onSubscribeError = s.events.OnSubscribeError
+	}
+	if onSubscribeError != nil {
+		s.dispatch(func() {
+			s.handle(SubEventSubscribeError, func() error { return onSubscribeError(s, err) })
+		}, false)
+	}
+}
+
+// recover replays missed messages received in subscribe response and then
+// live messages held back while recovering. Server sends missed messages
+// newest first so they are replayed in reverse order. Every message is
+// delivered at most once.
+func (s *Sub) recover(lastMessageID *libcentrifugo.MessageID, missed []libcentrifugo.Message) {
+	s.mutex.Lock()
+	delivered := s.lastMessageID
+	s.mutex.Unlock()
+	if delivered != nil {
+		// Messages queued before resubscribe are delivered already.
+		for i, m := range missed {
+			if m.UID == *delivered {
+				missed = missed[:i]
+				break
+			}
+		}
+	}
+
+	seen := make(map[libcentrifugo.MessageID]struct{}, len(missed))
+	if lastMessageID != nil {
+		seen[*lastMessageID] = struct{}{}
+	}
+	targets := s.targets()
+	deliver := func(m libcentrifugo.Message) {
+		if _, ok := seen[m.UID]; ok {
+			return
+		}
+		seen[m.UID] = struct{}{}
+		s.deliverMessage(m, targets)
+	}
+
+	for i := len(missed) - 1; i >= 0; i-- {
+		deliver(missed[i])
+	}
+
+	for {
+		s.mutex.Lock()
+		pending := s.pending
+		s.pending = nil
+		if len(pending) == 0 {
+			s.recovering = false
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+		for _, m := range pending {
+			deliver(m)
+		}
+	}
 }
 
 func (c *centrifugeImpl) nextMsgID() int32 {
@@ -300,12 +727,14 @@ func NewCentrifuge(url, project string, creds *Credentials, events *EventHandler
 		closed:      make(chan struct{}),
 		waiters:     make(map[string]chan response),
 		events:      events,
-		reconnect:   true,
 
 		project:          libcentrifugo.ProjectKey(project),
 		wgworkers:        sync.WaitGroup{},
 		createConnection: NewWSConnection,
 	}
+	if config.ConnectionFactory != nil {
+		c.createConnection = config.ConnectionFactory
+	}
 
 	return c
 }
@@ -317,6 +746,44 @@ func (c *centrifugeImpl) connected() bool {
 	return c.status == CONNECTED
 }
 
+// Status returns actual connection status.
+func (c *centrifugeImpl) Status() Status {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.status
+}
+
+// Lock must be held outside
+func (c *centrifugeImpl) setStatus(status Status) {
+	oldStatus := c.status
+	c.status = status
+	if oldStatus == status || c.events == nil || c.events.OnStateChange == nil {
+		return
+	}
+	c.statusChangesMutex.Lock()
+	c.statusChanges = append(c.statusChanges, statusChange{oldStatus: oldStatus, newStatus: status})
+	c.statusChangesMutex.Unlock()
+	// Notify outside of lock so handler is free to call client methods.
+	go c.notifyStatusChanges()
+}
+
+func (c *centrifugeImpl) notifyStatusChanges() {
+	c.notifyMutex.Lock()
+	defer c.notifyMutex.Unlock()
+	for {
+		c.statusChangesMutex.Lock()
+		changes := c.statusChanges
+		c.statusChanges = nil
+		c.statusChangesMutex.Unlock()
+		if len(changes) == 0 {
+			return
+		}
+		for _, change := range changes {
+			c.events.OnStateChange(c, change.oldStatus, change.newStatus)
+		}
+	}
+}
+
 // Subscribed returns true if client subscribed on channel.
 func (c *centrifugeImpl) subscribed(channel string) bool {
 	c.subsMutex.RLock()
@@ -342,22 +809,45 @@ func (c *centrifugeImpl) handleError(err error) {
 	if onError != nil {
 		onError(c, err)
 	} else {
-		log.Println(err)
-		c.Close()
+		c.log(LogLevelError, "closing client on error", "error", err)
+		// Called on run goroutine which Close waits for.
+		go c.Close()
 	}
 }
 
 // Close closes Centrifuge connection and clean ups everything.
 func (c *centrifugeImpl) Close() {
+	// Release consumers first, blocked channel stops replies to unsubscribe.
+	for _, sub := range c.subList() {
+		sub.closeChannels(UnsubscribeClose)
+	}
+
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.unsubscribeAll()
+	subs := c.unsubscribeAll()
 	c.close()
+	c.mutex.Unlock()
+
+	for _, sub := range subs {
+		sub.unsubscribed(UnsubscribeClose)
+	}
+}
+
+// dropWorkers stops connection which failed to connect or resubscribe and
+// waits for its workers.
+// Lock must be held outside
+func (c *centrifugeImpl) dropWorkers() {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	c.conn.Close()
+	c.wgworkers.Wait()
 }
 
 // close closes Centrifuge connection only
 func (c *centrifugeImpl) close() {
-	c.status = CLOSING
+	c.setStatus(CLOSING)
 	if c.conn != nil {
 		c.conn.Close()
 	}
@@ -377,24 +867,51 @@ func (c *centrifugeImpl) close() {
 
 	c.wgworkers.Wait()
 
-	c.status = CLOSED
+	c.setStatus(CLOSED)
 }
 
-// unsubscribeAll destroy all subscriptions
-func (c *centrifugeImpl) unsubscribeAll() {
-	if c.conn != nil && c.status == CONNECTED {
-		for ch, sub := range c.subs {
-			err := c.unsubscribe(sub.Channel)
+// unsubscribeAll destroy all subscriptions and returns removed ones
+// Lock must be held outside
+func (c *centrifugeImpl) unsubscribeAll() []*Sub {
+	var removed []*Sub
+	for _, sub := range c.subList() {
+		if c.conn != nil && c.status == CONNECTED {
+			_, err := c.sendUnsubscribe(context.Background(), sub.Channel)
 			if err != nil {
-				log.Println(err)
+				c.log(LogLevelWarn, "unsubscribe failed", "channel", sub.Channel, "error", err)
 			}
-			delete(c.subs, ch)
+		}
+		if c.removeSub(sub) {
+			removed = append(removed, sub)
 		}
 	}
+	return removed
+}
+
+func (c *centrifugeImpl) subList() []*Sub {
+	c.subsMutex.RLock()
+	defer c.subsMutex.RUnlock()
+	subs := make([]*Sub, 0, len(c.subs))
+	for _, sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// removeSub removes sub from client. It returns false when sub was already
+// removed, so unsubscribe is only handled once.
+func (c *centrifugeImpl) removeSub(sub *Sub) bool {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	if c.subs[sub.Channel] != sub {
+		return false
+	}
+	delete(c.subs, sub.Channel)
+	return true
 }
 
 func (c *centrifugeImpl) handleDisconnect(err error) {
-	log.Print("handleDisconnect - invoked")
+	c.log(LogLevelDebug, "connection lost", "error", err)
 	c.mutex.Lock()
 	if c.status == CLOSING || c.status == CLOSED || c.status == RECONNECTING {
 		c.mutex.Unlock()
@@ -420,7 +937,12 @@ func (c *centrifugeImpl) handleDisconnect(err error) {
 
 	c.wgworkers.Wait()
 
-	c.status = DISCONNECTED
+	c.setStatus(DISCONNECTED)
+	for _, sub := range c.subList() {
+		if sub.State() == SubSubscribed {
+			sub.setState(SubSubscribing, nil)
+		}
+	}
 
 	var onDisconnect DisconnectHandler
 	if c.events != nil && c.events.OnDisconnect != nil {
@@ -433,12 +955,21 @@ func (c *centrifugeImpl) handleDisconnect(err error) {
 		onDisconnect(c)
 	}
 
+	if c.config.ReconnectStrategy != nil {
+		c.Reconnect(c.config.ReconnectStrategy)
+	}
 }
 
+// ReconnectStrategy decides how long client waits before every reconnect
+// attempt. Client owns the retry loop: before attempt number attempt
+// (starting from 1) it calls NextDelay with error of previous attempt (nil
+// for the first one) and gives up when NextDelay returns false.
+// Implementations must be safe for use by several clients at once.
 type ReconnectStrategy interface {
-	reconnect(c *centrifugeImpl) error
+	NextDelay(attempt int, lastErr error) (time.Duration, bool)
 }
 
+// PeriodicReconnect waits fixed interval before every attempt.
 type PeriodicReconnect struct {
 	ReconnectInterval time.Duration
 	NumReconnect      int
@@ -449,31 +980,15 @@ var DefaultPeriodicReconnect = &PeriodicReconnect{
 	NumReconnect:      0,
 }
 
-func (r *PeriodicReconnect) reconnect(c *centrifugeImpl) error {
-	reconnects := 0
-	for {
-		if r.NumReconnect > 0 && reconnects >= r.NumReconnect {
-			break
-		}
-		time.Sleep(r.ReconnectInterval)
-
-		reconnects += 1
-
-		err, stop := c.doReconnect()
-		if stop {
-			break
-		}
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		// successfully reconnected
-		return nil
+func (r *PeriodicReconnect) NextDelay(attempt int, lastErr error) (time.Duration, bool) {
+	if r.NumReconnect > 0 && attempt > r.NumReconnect {
+		return 0, false
 	}
-	return ErrReconnectFailed
+	return r.ReconnectInterval, true
 }
 
+// BackoffReconnect is capped exponential backoff: delay grows Factor times
+// with every attempt from Min up to Max.
 type BackoffReconnect struct {
 	// NumReconnect is maximum number of reconnect attempts, 0 means reconnect forever
 	NumReconnect int
@@ -493,28 +1008,97 @@ var DefaultBackoffReconnect = &BackoffReconnect{
 	Jitter:       true,
 }
 
-func (r *BackoffReconnect) reconnect(c *centrifugeImpl) error {
+func (r *BackoffReconnect) NextDelay(attempt int, lastErr error) (time.Duration, bool) {
+	if r.NumReconnect > 0 && attempt > r.NumReconnect {
+		return 0, false
+	}
 	b := &backoff.Backoff{
 		Min:    r.Min,
 		Max:    r.Max,
 		Factor: r.Factor,
 		Jitter: r.Jitter,
 	}
-	reconnects := 0
-	for {
-		if r.NumReconnect > 0 && reconnects >= r.NumReconnect {
-			break
+	return b.ForAttempt(float64(attempt - 1)), true
+}
+
+// DecorrelatedJitterReconnect waits random delay between Base and three
+// times previous delay, capped by Max. Every delay is drawn as attempt-th
+// step of such sequence so strategy keeps no state between calls.
+type DecorrelatedJitterReconnect struct {
+	// NumReconnect is maximum number of reconnect attempts, 0 means reconnect forever
+	NumReconnect int
+	Base, Max    time.Duration
+}
+
+var DefaultDecorrelatedJitterReconnect = &DecorrelatedJitterReconnect{
+	NumReconnect: 0,
+	Base:         100 * time.Millisecond,
+	Max:          10 * time.Second,
+}
+
+// maxJitterSteps bounds work done by DecorrelatedJitterReconnect, sequence
+// is long settled near Max by then.
+const maxJitterSteps = 64
+
+func (r *DecorrelatedJitterReconnect) NextDelay(attempt int, lastErr error) (time.Duration, bool) {
+	if r.NumReconnect > 0 && attempt > r.NumReconnect {
+		return 0, false
+	}
+	if attempt > maxJitterSteps {
+		attempt = maxJitterSteps
+	}
+	delay := r.Base
+	for i := 0; i < attempt; i++ {
+		upper := 3 * delay
+		if upper > r.Max {
+			upper = r.Max
+		}
+		delay = r.Base
+		if upper > r.Base {
+			delay += time.Duration(rand.Int63n(int64(upper - r.Base)))
 		}
-		time.Sleep(b.Duration())
+	}
+	return delay, true
+}
 
-		reconnects += 1
+// ScheduleReconnect waits delays from Schedule one after another. When
+// schedule is exhausted it gives up, or keeps waiting last delay if
+// RepeatLast is set.
+type ScheduleReconnect struct {
+	Schedule   []time.Duration
+	RepeatLast bool
+}
+
+func (r *ScheduleReconnect) NextDelay(attempt int, lastErr error) (time.Duration, bool) {
+	if len(r.Schedule) == 0 {
+		return 0, false
+	}
+	if attempt > len(r.Schedule) {
+		if !r.RepeatLast {
+			return 0, false
+		}
+		attempt = len(r.Schedule)
+	}
+	return r.Schedule[attempt-1], true
+}
+
+// reconnectLoop runs reconnect attempts paced by strategy.
+func (c *centrifugeImpl) reconnectLoop(strategy ReconnectStrategy) error {
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		delay, ok := strategy.NextDelay(attempt, lastErr)
+		if !ok {
+			break
+		}
+		time.Sleep(delay)
 
 		err, stop := c.doReconnect()
 		if stop {
 			break
 		}
 		if err != nil {
-			log.Println(err)
+			c.log(LogLevelWarn, "reconnect attempt failed", "attempt", attempt, "error", err)
+			lastErr = err
 			continue
 		}
 
@@ -532,71 +1116,124 @@ func (c *centrifugeImpl) doReconnect() (error, bool) {
 		return errors.New("client closed"), true
 	}
 
-	c.closed = make(chan struct{})
-
-	err := c.connect()
-	if err != nil {
-		close(c.closed)
-		return err, false
+	err := c.connect(context.Background())
+	if err == nil {
+		// Failed subscriptions do not fail reconnect, only lost connection.
+		err = c.resubscribe(context.Background())
+		if err != nil {
+			// Drop connection and preserve all subscriptions for next attempt.
+			c.dropWorkers()
+		}
 	}
-
-	err = c.resubscribe()
+	c.observeReconnect(err)
 	if err != nil {
-		// we need just close the connection and preserve all subscriptions
-		c.close()
 		return err, false
 	}
 
+	// Connection is usable only after resubscribe, status stays
+	// RECONNECTING until then.
+	c.setStatus(CONNECTED)
 	return nil, false
 }
 
+// Reconnect restores lost connection using strategy. It fails with
+// ErrClientStatus when client is connected, already reconnecting or closed.
 func (c *centrifugeImpl) Reconnect(strategy ReconnectStrategy) error {
 
-	c.mutex.Lock()
-	reconnect := c.reconnect
-	c.mutex.Unlock()
-	if !reconnect {
+	if c.noReconnect.Load() {
 		return ErrReconnectForbidden
 	}
 	c.mutex.Lock()
-	c.status = RECONNECTING
+	switch c.status {
+	case CONNECTED, RECONNECTING, CLOSING, CLOSED:
+		c.mutex.Unlock()
+		return ErrClientStatus
+	}
+	c.setStatus(RECONNECTING)
 	c.mutex.Unlock()
-	return strategy.reconnect(c)
+
+	var onReconnecting, onReconnected ReconnectHandler
+	if c.events != nil {
+		onReconnecting = c.events.OnReconnecting
+		onReconnected = c.events.OnReconnected
+	}
+
+	c.log(LogLevelInfo, "reconnecting")
+	if onReconnecting != nil {
+		onReconnecting(c)
+	}
+	err := c.reconnectLoop(strategy)
+	if err != nil {
+		c.log(LogLevelError, "reconnect failed", "error", err)
+		c.mutex.Lock()
+		if c.status == RECONNECTING {
+			c.setStatus(DISCONNECTED)
+		}
+		c.mutex.Unlock()
+		return err
+	}
+	c.log(LogLevelInfo, "reconnected")
+	if onReconnected != nil {
+		onReconnected(c)
+	}
+	return nil
 }
 
-func (c *centrifugeImpl) resubscribe() error {
-	for _, sub := range c.subs {
-		err := sub.resubscribe()
-		if err != nil {
+// resubscribe subscribes all subs again. Subs which failed are left in
+// SubFailed state, error is only returned when connection failed.
+func (c *centrifugeImpl) resubscribe(ctx context.Context) error {
+	for _, err := range c.subscribe(ctx, c.subList()) {
+		if connectionError(err) {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *centrifugeImpl) read() {
+func (c *centrifugeImpl) resubscribeSub(ctx context.Context, sub *Sub) error {
+	if !c.connected() {
+		return ErrClientDisconnected
+	}
+	c.subsMutex.RLock()
+	current := c.subs[sub.Channel] == sub
+	c.subsMutex.RUnlock()
+	if !current {
+		return ErrClientStatus
+	}
+	if sub.State() == SubSubscribed {
+		return nil
+	}
+	return c.subscribe(ctx, []*Sub{sub})[0]
+}
+
+// read reads from conn until it fails. Failure is not handled as
+// disconnect when closed was closed, connection was dropped by client then.
+func (c *centrifugeImpl) read(conn Connection, closed chan struct{}) {
 	for {
-		log.Print("read")
-		message, err := c.conn.ReadMessage()
+		message, err := conn.ReadMessage()
 		if err != nil {
+			select {
+			case <-closed:
+				return
+			default:
+			}
 			c.handleDisconnect(err)
 			return
 		}
+		c.observeQueue(QueueReceive, c.receive)
 		select {
-		case <-c.closed:
+		case c.receive <- message:
+		case <-closed:
 			return
-		default:
-			c.receive <- message
 		}
 	}
 }
 
+// run is counted in wgworkers by caller.
 func (c *centrifugeImpl) run() {
-	c.wgworkers.Add(1)
 	defer c.wgworkers.Done()
 
 	for {
-		log.Print("run")
 		select {
 		case msg := <-c.receive:
 			err := c.handle(msg)
@@ -604,50 +1241,88 @@ func (c *centrifugeImpl) run() {
 				c.handleError(err)
 			}
 		case msg := <-c.write:
-			err := c.conn.WriteMessage(msg)
+			err := c.writeFrame(c.batch(msg))
+			c.observeQueue(QueueWrite, c.write)
 			if err != nil {
-				c.handleError(err)
+				// Connection is lost, closing it makes read fail and start
+				// disconnect flow, so client reconnects.
+				c.log(LogLevelWarn, "write failed", "error", err)
+				c.conn.Close()
 			}
 		case <-c.closed:
+			c.drain()
 			return
 		}
 	}
 }
 
-var (
-	arrayJsonPrefix  byte = '['
-	objectJsonPrefix byte = '{'
-)
+// drain handles frames received before connection was lost, e.g.
+// disconnect message telling whether client may reconnect.
+func (c *centrifugeImpl) drain() {
+	for {
+		select {
+		case msg := <-c.receive:
+			err := c.handle(msg)
+			if err != nil {
+				c.log(LogLevelWarn, "failed to handle message", "error", err)
+			}
+		default:
+			return
+		}
+	}
+}
 
-func responsesFromClientMsg(msg []byte) ([]response, error) {
-	var resps []response
-	firstByte := msg[0]
-	switch firstByte {
-	case objectJsonPrefix:
-		// single command request
-		var resp response
-		err := json.Unmarshal(msg, &resp)
-		if err != nil {
-			return nil, err
+// batch coalesces first and frames queued after it into one frame
+// according to Config.WriteBatchSize and Config.WriteBatchWindow, frames
+// are counted whatever number of commands they hold. Received
+// frames are handled while waiting, so window does not delay replies.
+func (c *centrifugeImpl) batch(first []byte) []byte {
+	if c.config.WriteBatchSize < 2 {
+		return first
+	}
+	msgs := [][]byte{first}
+
+	var window <-chan time.Time
+	if c.config.WriteBatchWindow > 0 {
+		timer := time.NewTimer(c.config.WriteBatchWindow)
+		defer timer.Stop()
+		window = timer.C
+	}
+
+collect:
+	for len(msgs) < c.config.WriteBatchSize {
+		if window == nil {
+			select {
+			case msg := <-c.write:
+				msgs = append(msgs, msg)
+			default:
+				break collect
+			}
+			continue
 		}
-		resps = append(resps, resp)
-	case arrayJsonPrefix:
-		// array of commands received
-		err := json.Unmarshal(msg, &resps)
-		if err != nil {
-			return nil, err
+		select {
+		case msg := <-c.write:
+			msgs = append(msgs, msg)
+		case msg := <-c.receive:
+			err := c.handle(msg)
+			if err != nil {
+				c.handleError(err)
+			}
+		case <-window:
+			break collect
+		case <-c.closed:
+			break collect
 		}
-	default:
-		return nil, ErrUnexpectedMessageData
 	}
-	return resps, nil
+
+	return c.codec().JoinFrames(msgs)
 }
 
 func (c *centrifugeImpl) handle(msg []byte) error {
 	if len(msg) == 0 {
 		return nil
 	}
-	resps, err := responsesFromClientMsg(msg)
+	resps, err := c.decodeResponses(msg)
 	if err != nil {
 		return err
 	}
@@ -679,7 +1354,7 @@ func (c *centrifugeImpl) handleAsyncResponse(resp response) error {
 	switch method {
 	case "message":
 		var m libcentrifugo.Message
-		err := json.Unmarshal(body, &m)
+		err := c.codec().Unmarshal(body, &m)
 		if err != nil {
 			// Malformed message received.
 			return errors.New("malformed message received from server")
@@ -689,15 +1364,15 @@ func (c *centrifugeImpl) handleAsyncResponse(resp response) error {
 		sub, ok := c.subs[string(channel)]
 		c.subsMutex.RUnlock()
 		if !ok {
-			log.Println("message received but client not subscribed on channel")
+			c.log(LogLevelDebug, "message received but client not subscribed on channel", "channel", channel)
 			return nil
 		}
 		sub.handleMessage(m)
 	case "join":
 		var b libcentrifugo.JoinLeaveBody
-		err := json.Unmarshal(body, &b)
+		err := c.codec().Unmarshal(body, &b)
 		if err != nil {
-			log.Println("malformed join message")
+			c.log(LogLevelWarn, "malformed join message", "error", err)
 			return nil
 		}
 		channel := b.Channel
@@ -705,16 +1380,15 @@ func (c *centrifugeImpl) handleAsyncResponse(resp response) error {
 		sub, ok := c.subs[string(channel)]
 		c.subsMutex.RUnlock()
 		if !ok {
-			log.Println("join received but client not subscribed on channel")
-			c.mutex.RUnlock()
+			c.log(LogLevelDebug, "join received but client not subscribed on channel", "channel", channel)
 			return nil
 		}
 		sub.handleJoinMessage(b.Data)
 	case "leave":
 		var b libcentrifugo.JoinLeaveBody
-		err := json.Unmarshal(body, &b)
+		err := c.codec().Unmarshal(body, &b)
 		if err != nil {
-			log.Println("malformed leave message")
+			c.log(LogLevelWarn, "malformed leave message", "error", err)
 			return nil
 		}
 		channel := b.Channel
@@ -722,107 +1396,194 @@ func (c *centrifugeImpl) handleAsyncResponse(resp response) error {
 		sub, ok := c.subs[string(channel)]
 		c.subsMutex.RUnlock()
 		if !ok {
-			log.Println("leave received but client not subscribed on channel")
-			c.mutex.RUnlock()
+			c.log(LogLevelDebug, "leave received but client not subscribed on channel", "channel", channel)
 			return nil
 		}
 		sub.handleLeaveMessage(b.Data)
+	case "unsubscribe":
+		var b libcentrifugo.UnsubscribeBody
+		err := c.codec().Unmarshal(body, &b)
+		if err != nil {
+			c.log(LogLevelWarn, "malformed unsubscribe message", "error", err)
+			return nil
+		}
+		c.subsMutex.RLock()
+		sub, ok := c.subs[string(b.Channel)]
+		c.subsMutex.RUnlock()
+		if ok && c.removeSub(sub) {
+			c.log(LogLevelInfo, "unsubscribed by server", "channel", b.Channel)
+			sub.unsubscribed(UnsubscribeServer)
+		}
 	case "disconnect":
-		c.handleDisconnectMessage("disconnected", c.config.Reconnect)
+		var b libcentrifugo.DisconnectBody
+		err := c.codec().Unmarshal(body, &b)
+		if err != nil {
+			c.log(LogLevelWarn, "malformed disconnect message", "error", err)
+			return nil
+		}
+		c.handleDisconnectMessage(b.Reason, b.Reconnect && c.config.Reconnect)
 	default:
 		return nil
 	}
 	return nil
 }
 
+// handleDisconnectMessage is called on run goroutine, so it must not wait
+// for workers. Connection is dropped to be handled by handleDisconnect and
+// ReconnectStrategy when server allows reconnect, otherwise client is
+// closed.
 func (c *centrifugeImpl) handleDisconnectMessage(reason string, shouldReconnect bool) error {
-	if !shouldReconnect {
-		c.mutex.Lock()
-		c.reconnect = false
-		c.mutex.Unlock()
+	c.log(LogLevelInfo, "disconnected by server", "reason", reason, "reconnect", shouldReconnect)
+	if shouldReconnect {
+		// Connection is only replaced after run returns.
+		c.conn.Close()
+		return nil
 	}
-	log.Printf("disconnected: %s\n", reason)
-	c.Close()
+	c.noReconnect.Store(true)
+	go c.Close()
 	return nil
 }
 
 // Lock must be held outside
-func (c *centrifugeImpl) connectWS() error {
-	conn, err := c.createConnection(c.url, c.config.Timeout)
+func (c *centrifugeImpl) connectWS(ctx context.Context) error {
+	conn, err := c.createConnection(ctx, c.url, c.config.Timeout)
 	if err != nil {
 		return err
 	}
+	if _, ok := conn.(BinaryConnection); c.codec().Binary() && !ok {
+		conn.Close()
+		return ErrBinaryNotSupported
+	}
 	c.conn = conn
 	return nil
 }
 
+func (c *centrifugeImpl) writeFrame(frame []byte) error {
+	if c.codec().Binary() {
+		return c.conn.(BinaryConnection).WriteBinaryMessage(frame)
+	}
+	return c.conn.WriteMessage(frame)
+}
+
+// connect dials server with ctx and sends connect command. Connection
+// and its workers are stopped when it fails. Caller sets CONNECTED status.
 // Lock must be held outside
-func (c *centrifugeImpl) connect() error {
+func (c *centrifugeImpl) connect(ctx context.Context) error {
+	select {
+	case <-c.closed:
+		c.closedMutex.Lock()
+		c.closed = make(chan struct{})
+		c.closedMutex.Unlock()
+	default:
+	}
 
-	err := c.connectWS()
+	err := c.connectWS(ctx)
 	if err != nil {
 		return err
 	}
 
+	c.wgworkers.Add(1)
 	go c.run()
 
-	go c.read()
+	go c.read(c.conn, c.closed)
 
-	var body libcentrifugo.ConnectBody
-
-	body, err = c.sendConnect()
-	if err != nil {
-		return err
-	}
-
-	if body.Expired {
+	body, err := c.sendConnect(ctx)
+	if err == nil && body.Expired {
 		// Try to refresh credentials and repeat connection attempt.
 		err = c.refreshCredentials()
-		if err != nil {
-			return err
+		if err == nil {
+			body, err = c.sendConnect(ctx)
 		}
-		body, err = c.sendConnect()
-		if err != nil {
-			return err
-		}
-		if body.Expired {
-			return ErrClientExpired
+		if err == nil && body.Expired {
+			err = ErrClientExpired
 		}
 	}
+	if err != nil {
+		c.dropWorkers()
+		return err
+	}
 
 	c.clientID = *body.Client
 
-	if body.TTL != nil && *body.TTL > 0 {
-		go func(interval int64) {
-			c.wgworkers.Add(1)
-			defer c.wgworkers.Done()
-
-			tick := time.After(time.Duration(interval) * time.Second)
-			select {
-			case <-c.closed:
-				return
-			case <-tick:
-				err := c.sendRefresh()
-				if err != nil {
-					log.Println(err)
-				}
-			}
-		}(*body.TTL)
+	if body.Expires && body.TTL != nil && *body.TTL > 0 {
+		c.wgworkers.Add(1)
+		go c.refresh(c.conn, c.closed, time.Duration(*body.TTL)*time.Second)
 	}
 
-	c.status = CONNECTED
+	if c.config.PingInterval > 0 {
+		c.wgworkers.Add(1)
+		go c.ping(c.conn, c.closed, c.config.PingInterval)
+	}
 
 	return nil
 }
 
 // Connect connects to Centrifugo and sends connect message to authorize.
 func (c *centrifugeImpl) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect but gives up waiting for server replies
+// with ctx.Err() as soon as ctx is done.
+func (c *centrifugeImpl) ConnectContext(ctx context.Context) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	if c.status == CONNECTED {
 		return ErrClientStatus
 	}
-	return c.connect()
+	err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	c.setStatus(CONNECTED)
+	return nil
+}
+
+// ping sends ping commands until connection closed. Missing reply means
+// connection is dead, closing it makes read fail and start disconnect flow.
+func (c *centrifugeImpl) ping(conn Connection, closed chan struct{}, interval time.Duration) {
+	defer c.wgworkers.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			err := c.sendPing(context.Background())
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrTimeout):
+				c.log(LogLevelWarn, "ping timed out, closing connection")
+				conn.Close()
+				return
+			case errors.Is(err, ErrClientDisconnected), errors.Is(err, ErrWaiterClosed):
+				return
+			default:
+				c.log(LogLevelWarn, "ping failed", "error", err)
+			}
+		}
+	}
+}
+
+func (c *centrifugeImpl) sendPing(ctx context.Context) error {
+	cmd := clientCommand{
+		UID:    strconv.Itoa(int(c.nextMsgID())),
+		Method: "ping",
+	}
+	cmdBytes, err := c.encodeCommand(cmd)
+	if err != nil {
+		return err
+	}
+	r, err := c.sendSync(ctx, cmd, cmdBytes)
+	if err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return newServerError(r)
+	}
+	return nil
 }
 
 func (c *centrifugeImpl) refreshCredentials() error {
@@ -842,11 +1603,66 @@ func (c *centrifugeImpl) refreshCredentials() error {
 	return nil
 }
 
-func (c *centrifugeImpl) sendRefresh() error {
+// refresh refreshes credentials ahead of connection expiry and re-arms
+// with TTL returned by server. Failed refresh is retried with backoff from
+// tenth of TTL up to TTL. When server reports credentials expired conn is
+// dropped, so client reconnects if Config.ReconnectStrategy is set.
+func (c *centrifugeImpl) refresh(conn Connection, closed chan struct{}, ttl time.Duration) {
+	defer c.wgworkers.Done()
+
+	delay := refreshDelay(ttl)
+	retry := &backoff.Backoff{Min: ttl / 10, Max: ttl, Factor: 2, Jitter: true}
+	for {
+		select {
+		case <-closed:
+			return
+		case <-time.After(delay):
+		}
+
+		body, err := c.sendRefresh(context.Background())
+		if err == nil && body.Expired {
+			err = ErrClientExpired
+		}
+		c.observeRefresh(err)
+		switch {
+		case errors.Is(err, ErrClientExpired):
+			c.log(LogLevelError, "credentials expired, dropping connection")
+			var onError ErrorHandler
+			if c.events != nil && c.events.OnError != nil {
+				onError = c.events.OnError
+			}
+			conn.Close()
+			if onError != nil {
+				// Not called on worker, OnError may Close client which
+				// waits for workers.
+				go onError(c, err)
+			}
+			return
+		case err != nil:
+			delay = retry.Duration()
+			c.log(LogLevelWarn, "refresh failed", "error", err, "retry", delay)
+		case !body.Expires || body.TTL == nil || *body.TTL <= 0:
+			return
+		default:
+			retry.Reset()
+			ttl = time.Duration(*body.TTL) * time.Second
+			retry.Min, retry.Max = ttl/10, ttl
+			delay = refreshDelay(ttl)
+		}
+	}
+}
+
+// refreshDelay is between 70% and 90% of ttl, so clients connected at the
+// same time do not refresh at once.
+func refreshDelay(ttl time.Duration) time.Duration {
+	return ttl*7/10 + time.Duration(rand.Int63n(int64(ttl)/5+1))
+}
+
+func (c *centrifugeImpl) sendRefresh(ctx context.Context) (libcentrifugo.ConnectBody, error) {
 
 	err := c.refreshCredentials()
 	if err != nil {
-		return err
+		return libcentrifugo.ConnectBody{}, err
 	}
 
 	params := c.refreshParams(c.credentials)
@@ -855,40 +1671,23 @@ func (c *centrifugeImpl) sendRefresh() error {
 		Method: "refresh",
 		Params: params,
 	}
-	cmdBytes, err := json.Marshal(cmd)
+	cmdBytes, err := c.encodeCommand(cmd)
 	if err != nil {
-		return err
+		return libcentrifugo.ConnectBody{}, err
 	}
-	r, err := c.sendSync(cmd.UID, cmdBytes)
+	r, err := c.sendSync(ctx, cmd, cmdBytes)
 	if err != nil {
-		return err
+		return libcentrifugo.ConnectBody{}, err
 	}
 	if r.Error != "" {
-		return errors.New(r.Error)
+		return libcentrifugo.ConnectBody{}, newServerError(r)
 	}
 	var body libcentrifugo.ConnectBody
-	err = json.Unmarshal(r.Body, &body)
+	err = c.codec().Unmarshal(r.Body, &body)
 	if err != nil {
-		return err
+		return libcentrifugo.ConnectBody{}, err
 	}
-	//	if body.Expires {
-	//		if body.Expired {
-	//			return ErrClientExpired
-	//		}
-	//		go func(interval int64) {
-	//			tick := time.After(time.Duration(interval) * time.Second)
-	//			select {
-	//			case <-c.closed:
-	//				return
-	//			case <-tick:
-	//				err := c.sendRefresh()
-	//				if err != nil {
-	//					log.Println(err)
-	//				}
-	//			}
-	//		}(body.TTL)
-	//	}
-	return nil
+	return body, nil
 }
 
 func (c *centrifugeImpl) refreshParams(creds *Credentials) *libcentrifugo.RefreshClientCommand {
@@ -900,26 +1699,26 @@ func (c *centrifugeImpl) refreshParams(creds *Credentials) *libcentrifugo.Refres
 	}
 }
 
-func (c *centrifugeImpl) sendConnect() (libcentrifugo.ConnectBody, error) {
+func (c *centrifugeImpl) sendConnect(ctx context.Context) (libcentrifugo.ConnectBody, error) {
 	params := c.connectParams()
 	cmd := clientCommand{
 		UID:    strconv.Itoa(int(c.nextMsgID())),
 		Method: "connect",
 		Params: params,
 	}
-	cmdBytes, err := json.Marshal(cmd)
+	cmdBytes, err := c.encodeCommand(cmd)
 	if err != nil {
 		return libcentrifugo.ConnectBody{}, err
 	}
-	r, err := c.sendSync(cmd.UID, cmdBytes)
+	r, err := c.sendSync(ctx, cmd, cmdBytes)
 	if err != nil {
 		return libcentrifugo.ConnectBody{}, err
 	}
 	if r.Error != "" {
-		return libcentrifugo.ConnectBody{}, errors.New(r.Error)
+		return libcentrifugo.ConnectBody{}, newServerError(r)
 	}
 	var body libcentrifugo.ConnectBody
-	err = json.Unmarshal(r.Body, &body)
+	err = c.codec().Unmarshal(r.Body, &body)
 	if err != nil {
 		return libcentrifugo.ConnectBody{}, err
 	}
@@ -936,52 +1735,102 @@ func (c *centrifugeImpl) connectParams() *libcentrifugo.ConnectClientCommand {
 	}
 }
 
-func (s *Sub) initPrivateSign() error {
-	var err error
-	if strings.HasPrefix(s.Channel, s.centrifuge.config.PrivateChannelPrefix) {
-		if s.events != nil && s.events.OnPrivateSub != nil {
-			privateReq := newPrivateRequest(string(s.centrifuge.clientID), s.Channel)
+// Subscribe allows to subscribe on channel.
+func (c *centrifugeImpl) Subscribe(channel string, events *SubEventHandler) (*Sub, error) {
+	return c.SubscribeContext(context.Background(), channel, events)
+}
 
-			s.privateSign, err = s.events.OnPrivateSub(s.centrifuge, privateReq)
+// SubscribeContext is like Subscribe but respects ctx cancellation.
+func (c *centrifugeImpl) SubscribeContext(ctx context.Context, channel string, events *SubEventHandler) (*Sub, error) {
+	result := c.SubscribeManyContext(ctx, map[string]*SubEventHandler{channel: events})[channel]
+	return result.Sub, result.Err
+}
 
-			if err != nil {
-				return err
-			}
-		} else {
-			return errors.New("PrivateSubHandler must be set to handle private channel subscriptions")
-		}
-	}
-	return nil
+// SubscribeMany subscribes on all channels sending subscribe commands in one
+// frame. It returns result for every requested channel, ErrAlreadySubscribed
+// for channels client already has Sub on.
+func (c *centrifugeImpl) SubscribeMany(channels map[string]*SubEventHandler) map[string]SubscribeResult {
+	return c.SubscribeManyContext(context.Background(), channels)
 }
 
-// Subscribe allows to subscribe on channel.
-func (c *centrifugeImpl) Subscribe(channel string, events *SubEventHandler) (*Sub, error) {
+// SubscribeManyContext is like SubscribeMany but respects ctx cancellation.
+func (c *centrifugeImpl) SubscribeManyContext(ctx context.Context, channels map[string]*SubEventHandler) map[string]SubscribeResult {
+	results := make(map[string]SubscribeResult, len(channels))
 	if !c.connected() {
-		return nil, ErrClientDisconnected
+		for channel := range channels {
+			results[channel] = SubscribeResult{Err: ErrClientDisconnected}
+		}
+		return results
 	}
 
-	sub, err := c.newSub(channel, events)
-	if err != nil {
-		return nil, err
-	}
+	subs := make([]*Sub, 0, len(channels))
 	c.subsMutex.Lock()
-	c.subs[channel] = sub
+	for channel, events := range channels {
+		if _, ok := c.subs[channel]; ok {
+			results[channel] = SubscribeResult{Err: ErrAlreadySubscribed}
+			continue
+		}
+		sub := c.newSub(channel, events)
+		c.subs[channel] = sub
+		subs = append(subs, sub)
+	}
 	c.subsMutex.Unlock()
+	if len(subs) == 0 {
+		return results
+	}
 
-	_, err = c.sendSubscribe(channel, sub.lastMessageID, sub.privateSign)
+	errs := c.subscribe(ctx, subs)
 
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
-	if err != nil {
-		c.subsMutex.Lock()
-		delete(c.subs, channel)
-		c.subsMutex.Unlock()
-		return nil, err
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	for i, sub := range subs {
+		if errs[i] != nil {
+			if c.subs[sub.Channel] == sub {
+				delete(c.subs, sub.Channel)
+			}
+			results[sub.Channel] = SubscribeResult{Err: errs[i]}
+			continue
+		}
+		// Subscription on channel successfull.
+		results[sub.Channel] = SubscribeResult{Sub: sub}
+	}
+	return results
+}
+
+// subscribe sends subscribe commands for all subs in one frame and returns
+// error for each of them.
+func (c *centrifugeImpl) subscribe(ctx context.Context, subs []*Sub) []error {
+	errs := make([]error, len(subs))
+	lastMessageIDs := make([]*libcentrifugo.MessageID, len(subs))
+	params := make([]*libcentrifugo.SubscribeClientCommand, 0, len(subs))
+	sent := make([]int, 0, len(subs))
+	for _, sub := range subs {
+		sub.setState(SubSubscribing, nil)
+	}
+	signErrs := c.signPrivate(ctx, subs)
+	for i, sub := range subs {
+		if signErrs[i] != nil {
+			// Only this sub fails when private channel not signed.
+			errs[i] = signErrs[i]
+			sub.subscribeFailed(signErrs[i])
+			continue
+		}
+		p, lastMessageID := sub.subscribeParams()
+		lastMessageIDs[i] = lastMessageID
+		params = append(params, p)
+		sent = append(sent, i)
 	}
 
-	// Subscription on channel successfull.
-	return sub, nil
+	bodies, sendErrs := c.sendSubscribe(ctx, params)
+	for j, i := range sent {
+		if sendErrs[j] != nil && !connectionError(sendErrs[j]) {
+			// Server may have rejected cached sign.
+			c.signs.remove(subs[i].Channel)
+		}
+		subs[i].subscribed(lastMessageIDs[i], bodies[j], sendErrs[j])
+		errs[i] = sendErrs[j]
+	}
+	return errs
 }
 
 func (c *centrifugeImpl) subscribeParams(channel string, lastMessageID *libcentrifugo.MessageID, privateSign *PrivateSign) *libcentrifugo.SubscribeClientCommand {
@@ -994,37 +1843,40 @@ func (c *centrifugeImpl) subscribeParams(channel string, lastMessageID *libcentr
 		cmd.Info = privateSign.Info
 		cmd.Sign = privateSign.Sign
 	}
+
+	if lastMessageID != nil {
+		cmd.Recover = true
+		cmd.Last = *lastMessageID
+	}
 	return cmd
 }
 
-func (c *centrifugeImpl) sendSubscribe(channel string, lastMessageID *libcentrifugo.MessageID, privateSign *PrivateSign) (libcentrifugo.SubscribeBody, error) {
-	params := c.subscribeParams(channel, lastMessageID, privateSign)
-	cmd := clientCommand{
-		UID:    strconv.Itoa(int(c.nextMsgID())),
-		Method: "subscribe",
-		Params: params,
-	}
-	cmdBytes, err := json.Marshal(cmd)
-	if err != nil {
-		return libcentrifugo.SubscribeBody{}, err
-	}
-	r, err := c.sendSync(cmd.UID, cmdBytes)
-	if err != nil {
-		return libcentrifugo.SubscribeBody{}, err
-	}
-	if r.Error != "" {
-		return libcentrifugo.SubscribeBody{}, errors.New(r.Error)
+func (c *centrifugeImpl) sendSubscribe(ctx context.Context, params []*libcentrifugo.SubscribeClientCommand) ([]libcentrifugo.SubscribeBody, []error) {
+	cmds := make([]clientCommand, len(params))
+	for i, p := range params {
+		cmds[i] = clientCommand{
+			UID:    strconv.Itoa(int(c.nextMsgID())),
+			Method: "subscribe",
+			Params: p,
+		}
 	}
-	var body libcentrifugo.SubscribeBody
-	err = json.Unmarshal(r.Body, &body)
-	if err != nil {
-		return libcentrifugo.SubscribeBody{}, err
+	bodies := make([]libcentrifugo.SubscribeBody, len(cmds))
+	rs, errs := c.sendSyncMany(ctx, cmds)
+	for i, r := range rs {
+		if errs[i] != nil {
+			continue
+		}
+		if r.Error != "" {
+			errs[i] = newServerError(r)
+			continue
+		}
+		errs[i] = c.codec().Unmarshal(r.Body, &bodies[i])
 	}
-	return body, nil
+	return bodies, errs
 }
 
-func (c *centrifugeImpl) publish(channel string, data []byte) error {
-	body, err := c.sendPublish(channel, data)
+func (c *centrifugeImpl) publish(ctx context.Context, channel string, data []byte) error {
+	body, err := c.sendPublish(ctx, channel, data)
 	if err != nil {
 		return err
 	}
@@ -1034,6 +1886,87 @@ func (c *centrifugeImpl) publish(channel string, data []byte) error {
 	return nil
 }
 
+func (c *centrifugeImpl) publishAsync(channel string, data []byte, done func(error)) {
+	if done == nil {
+		done = func(error) {}
+	}
+	if !c.connected() {
+		// Write queue is not drained, send would block when it is full.
+		go done(ErrClientDisconnected)
+		return
+	}
+
+	inFlight := c.publishSemaphore()
+	inFlight <- struct{}{}
+
+	params := c.publishParams(channel, data)
+	cmd := clientCommand{
+		UID:    strconv.Itoa(int(c.nextMsgID())),
+		Method: "publish",
+		Params: params,
+	}
+	cmdBytes, err := c.encodeCommand(cmd)
+	if err != nil {
+		<-inFlight
+		go done(err)
+		return
+	}
+
+	wait := make(chan response, 1)
+	start := time.Now()
+	end := c.traceCommand(context.Background(), cmd)
+	err = c.addWaiter(cmd.UID, wait)
+	if err == nil {
+		err = c.send(context.Background(), cmdBytes)
+	}
+	if err != nil {
+		c.removeWaiter(cmd.UID)
+		<-inFlight
+		end(response{}, err)
+		c.observeCommand(cmd.Method, start, response{}, err)
+		go done(err)
+		return
+	}
+
+	go func() {
+		r, err := c.wait(context.Background(), wait, time.Now().Add(c.config.Timeout))
+		c.removeWaiter(cmd.UID)
+		<-inFlight
+		end(r, err)
+		c.observeCommand(cmd.Method, start, r, err)
+		if err != nil {
+			done(err)
+			return
+		}
+		if r.Error != "" {
+			done(newServerError(r))
+			return
+		}
+		var body libcentrifugo.PublishBody
+		err = c.codec().Unmarshal(r.Body, &body)
+		if err != nil {
+			done(err)
+			return
+		}
+		if !body.Status {
+			done(ErrBadPublishStatus)
+			return
+		}
+		done(nil)
+	}()
+}
+
+func (c *centrifugeImpl) publishSemaphore() chan struct{} {
+	c.publishOnce.Do(func() {
+		size := c.config.MaxPublishInFlight
+		if size <= 0 {
+			size = DefaultMaxPublishInFlight
+		}
+		c.publishInFlight = make(chan struct{}, size)
+	})
+	return c.publishInFlight
+}
+
 func (c *centrifugeImpl) publishParams(channel string, data []byte) *libcentrifugo.PublishClientCommand {
 	return &libcentrifugo.PublishClientCommand{
 		Channel: libcentrifugo.Channel(channel),
@@ -1041,34 +1974,34 @@ func (c *centrifugeImpl) publishParams(channel string, data []byte) *libcentrifu
 	}
 }
 
-func (c *centrifugeImpl) sendPublish(channel string, data []byte) (libcentrifugo.PublishBody, error) {
+func (c *centrifugeImpl) sendPublish(ctx context.Context, channel string, data []byte) (libcentrifugo.PublishBody, error) {
 	params := c.publishParams(channel, data)
 	cmd := clientCommand{
 		UID:    strconv.Itoa(int(c.nextMsgID())),
 		Method: "publish",
 		Params: params,
 	}
-	cmdBytes, err := json.Marshal(cmd)
+	cmdBytes, err := c.encodeCommand(cmd)
 	if err != nil {
 		return libcentrifugo.PublishBody{}, err
 	}
-	r, err := c.sendSync(cmd.UID, cmdBytes)
+	r, err := c.sendSync(ctx, cmd, cmdBytes)
 	if err != nil {
 		return libcentrifugo.PublishBody{}, err
 	}
 	if r.Error != "" {
-		return libcentrifugo.PublishBody{}, errors.New(r.Error)
+		return libcentrifugo.PublishBody{}, newServerError(r)
 	}
 	var body libcentrifugo.PublishBody
-	err = json.Unmarshal(r.Body, &body)
+	err = c.codec().Unmarshal(r.Body, &body)
 	if err != nil {
 		return libcentrifugo.PublishBody{}, err
 	}
 	return body, nil
 }
 
-func (c *centrifugeImpl) history(channel string) ([]libcentrifugo.Message, error) {
-	body, err := c.sendHistory(channel)
+func (c *centrifugeImpl) history(ctx context.Context, channel string) ([]libcentrifugo.Message, error) {
+	body, err := c.sendHistory(ctx, channel)
 	if err != nil {
 		return []libcentrifugo.Message{}, err
 	}
@@ -1081,34 +2014,34 @@ func (c *centrifugeImpl) historyParams(channel string) *libcentrifugo.HistoryCli
 	}
 }
 
-func (c *centrifugeImpl) sendHistory(channel string) (libcentrifugo.HistoryBody, error) {
+func (c *centrifugeImpl) sendHistory(ctx context.Context, channel string) (libcentrifugo.HistoryBody, error) {
 	params := c.historyParams(channel)
 	cmd := clientCommand{
 		UID:    strconv.Itoa(int(c.nextMsgID())),
 		Method: "history",
 		Params: params,
 	}
-	cmdBytes, err := json.Marshal(cmd)
+	cmdBytes, err := c.encodeCommand(cmd)
 	if err != nil {
 		return libcentrifugo.HistoryBody{}, err
 	}
-	r, err := c.sendSync(cmd.UID, cmdBytes)
+	r, err := c.sendSync(ctx, cmd, cmdBytes)
 	if err != nil {
 		return libcentrifugo.HistoryBody{}, err
 	}
 	if r.Error != "" {
-		return libcentrifugo.HistoryBody{}, errors.New(r.Error)
+		return libcentrifugo.HistoryBody{}, newServerError(r)
 	}
 	var body libcentrifugo.HistoryBody
-	err = json.Unmarshal(r.Body, &body)
+	err = c.codec().Unmarshal(r.Body, &body)
 	if err != nil {
 		return libcentrifugo.HistoryBody{}, err
 	}
 	return body, nil
 }
 
-func (c *centrifugeImpl) presence(channel string) (map[libcentrifugo.ConnID]libcentrifugo.ClientInfo, error) {
-	body, err := c.sendPresence(channel)
+func (c *centrifugeImpl) presence(ctx context.Context, channel string) (map[libcentrifugo.ConnID]libcentrifugo.ClientInfo, error) {
+	body, err := c.sendPresence(ctx, channel)
 	if err != nil {
 		return map[libcentrifugo.ConnID]libcentrifugo.ClientInfo{}, err
 	}
@@ -1121,46 +2054,49 @@ func (c *centrifugeImpl) presenceParams(channel string) *libcentrifugo.PresenceC
 	}
 }
 
-func (c *centrifugeImpl) sendPresence(channel string) (libcentrifugo.PresenceBody, error) {
+func (c *centrifugeImpl) sendPresence(ctx context.Context, channel string) (libcentrifugo.PresenceBody, error) {
 	params := c.presenceParams(channel)
 	cmd := clientCommand{
 		UID:    strconv.Itoa(int(c.nextMsgID())),
 		Method: "presence",
 		Params: params,
 	}
-	cmdBytes, err := json.Marshal(cmd)
+	cmdBytes, err := c.encodeCommand(cmd)
 	if err != nil {
 		return libcentrifugo.PresenceBody{}, err
 	}
-	r, err := c.sendSync(cmd.UID, cmdBytes)
+	r, err := c.sendSync(ctx, cmd, cmdBytes)
 	if err != nil {
 		return libcentrifugo.PresenceBody{}, err
 	}
 	if r.Error != "" {
-		return libcentrifugo.PresenceBody{}, errors.New(r.Error)
+		return libcentrifugo.PresenceBody{}, newServerError(r)
 	}
 	var body libcentrifugo.PresenceBody
-	err = json.Unmarshal(r.Body, &body)
+	err = c.codec().Unmarshal(r.Body, &body)
 	if err != nil {
 		return libcentrifugo.PresenceBody{}, err
 	}
 	return body, nil
 }
 
-func (c *centrifugeImpl) unsubscribe(channel string) error {
-	if !c.subscribed(channel) {
+func (c *centrifugeImpl) unsubscribe(ctx context.Context, sub *Sub) error {
+	c.subsMutex.RLock()
+	current := c.subs[sub.Channel] == sub
+	c.subsMutex.RUnlock()
+	if !current {
 		return nil
 	}
-	_, err := c.sendUnsubscribe(channel)
+	_, err := c.sendUnsubscribe(ctx, sub.Channel)
 	if err != nil {
 		return err
 	}
 	//	if !body.Status {
 	//		return ErrBadUnsubscribeStatus
 	//	}
-	c.subsMutex.Lock()
-	delete(c.subs, channel)
-	c.subsMutex.Unlock()
+	if c.removeSub(sub) {
+		sub.unsubscribed(UnsubscribeClient)
+	}
 	return nil
 }
 
@@ -1170,56 +2106,123 @@ func (c *centrifugeImpl) unsubscribeParams(channel string) *libcentrifugo.Unsubs
 	}
 }
 
-func (c *centrifugeImpl) sendUnsubscribe(channel string) (libcentrifugo.UnsubscribeBody, error) {
+func (c *centrifugeImpl) sendUnsubscribe(ctx context.Context, channel string) (libcentrifugo.UnsubscribeBody, error) {
 	params := c.unsubscribeParams(channel)
 	cmd := clientCommand{
 		UID:    strconv.Itoa(int(c.nextMsgID())),
 		Method: "unsubscribe",
 		Params: params,
 	}
-	cmdBytes, err := json.Marshal(cmd)
+	cmdBytes, err := c.encodeCommand(cmd)
 	if err != nil {
 		return libcentrifugo.UnsubscribeBody{}, err
 	}
-	r, err := c.sendSync(cmd.UID, cmdBytes)
+	r, err := c.sendSync(ctx, cmd, cmdBytes)
 	if err != nil {
 		return libcentrifugo.UnsubscribeBody{}, err
 	}
 	if r.Error != "" {
-		return libcentrifugo.UnsubscribeBody{}, errors.New(r.Error)
+		return libcentrifugo.UnsubscribeBody{}, newServerError(r)
 	}
 	var body libcentrifugo.UnsubscribeBody
-	err = json.Unmarshal(r.Body, &body)
+	err = c.codec().Unmarshal(r.Body, &body)
 	if err != nil {
 		return libcentrifugo.UnsubscribeBody{}, err
 	}
 	return body, nil
 }
 
-func (c *centrifugeImpl) sendSync(uid string, msg []byte) (response, error) {
-	wait := make(chan response)
-	err := c.addWaiter(uid, wait)
-	defer c.removeWaiter(uid)
+func (c *centrifugeImpl) sendSync(ctx context.Context, cmd clientCommand, msg []byte) (response, error) {
+	// Buffered so handle never blocks on a waiter which already gave up.
+	wait := make(chan response, 1)
+	err := c.addWaiter(cmd.UID, wait)
+	defer c.removeWaiter(cmd.UID)
 	if err != nil {
 		return response{}, err
 	}
-	err = c.send(msg)
+	start := time.Now()
+	end := c.traceCommand(ctx, cmd)
+	err = c.send(ctx, msg)
 	if err != nil {
+		end(response{}, err)
+		c.observeCommand(cmd.Method, start, response{}, err)
 		return response{}, err
 	}
-	return c.wait(wait)
+	r, err := c.wait(ctx, wait, time.Now().Add(c.config.Timeout))
+	end(r, err)
+	c.observeCommand(cmd.Method, start, r, err)
+	return r, err
+}
+
+// sendSyncMany sends all commands in one frame and waits for every reply.
+func (c *centrifugeImpl) sendSyncMany(ctx context.Context, cmds []clientCommand) ([]response, []error) {
+	rs := make([]response, len(cmds))
+	errs := make([]error, len(cmds))
+	waits := make([]chan response, len(cmds))
+	msgs := make([][]byte, 0, len(cmds))
+	for i, cmd := range cmds {
+		cmdBytes, err := c.encodeCommand(cmd)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		wait := make(chan response, 1)
+		err = c.addWaiter(cmd.UID, wait)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		defer c.removeWaiter(cmd.UID)
+		waits[i] = wait
+		msgs = append(msgs, cmdBytes)
+	}
+	if len(msgs) == 0 {
+		return rs, errs
+	}
+
+	// One deadline for all replies, waiting for each in turn must not take
+	// Timeout per command.
+	start := time.Now()
+	deadline := start.Add(c.config.Timeout)
+	ends := make([]func(response, error), len(cmds))
+	for i, wait := range waits {
+		if wait != nil {
+			ends[i] = c.traceCommand(ctx, cmds[i])
+		}
+	}
+	err := c.send(ctx, c.codec().JoinFrames(msgs))
+	for i, wait := range waits {
+		if wait == nil {
+			continue
+		}
+		if err != nil {
+			errs[i] = err
+		} else {
+			rs[i], errs[i] = c.wait(ctx, wait, deadline)
+		}
+		ends[i](rs[i], errs[i])
+		c.observeCommand(cmds[i].Method, start, rs[i], errs[i])
+	}
+	return rs, errs
 }
 
-func (c *centrifugeImpl) send(msg []byte) error {
+func (c *centrifugeImpl) send(ctx context.Context, msg []byte) error {
 	select {
-	case <-c.closed:
+	case c.write <- msg:
+	case <-c.closedChan():
 		return ErrClientDisconnected
-	default:
-		c.write <- msg
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 	return nil
 }
 
+func (c *centrifugeImpl) closedChan() chan struct{} {
+	c.closedMutex.RLock()
+	defer c.closedMutex.RUnlock()
+	return c.closed
+}
+
 func (c *centrifugeImpl) addWaiter(uid string, ch chan response) error {
 	c.waitersMutex.Lock()
 	defer c.waitersMutex.Unlock()
@@ -1237,16 +2240,32 @@ func (c *centrifugeImpl) removeWaiter(uid string) error {
 	return nil
 }
 
-func (c *centrifugeImpl) wait(ch chan response) (response, error) {
+// wait waits for reply on ch until deadline. Reply which is already
+// received is returned even when deadline passed.
+func (c *centrifugeImpl) wait(ctx context.Context, ch chan response, deadline time.Time) (response, error) {
 	select {
 	case data, ok := <-ch:
 		if !ok {
 			return response{}, ErrWaiterClosed
 		}
 		return data, nil
-	case <-time.After(c.config.Timeout):
+	default:
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case data, ok := <-ch:
+		if !ok {
+			return response{}, ErrWaiterClosed
+		}
+		return data, nil
+	case <-timer.C:
 		return response{}, ErrTimeout
-	case <-c.closed:
-		return response{}, ErrClientDisconnected
+	case <-c.closedChan():
+		// Command may have been sent already, unlike ErrClientDisconnected
+		// returned by send.
+		return response{}, ErrWaiterClosed
+	case <-ctx.Done():
+		return response{}, ctx.Err()
 	}
 }
@@ -1,10 +1,20 @@
 package centrifuge
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shilkin/centrifuge-go/centrifugetest"
 	"github.com/shilkin/centrifugo/libcentrifugo"
 	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -47,7 +57,7 @@ type connectionMock struct {
 	errTimeout bool
 }
 
-func (c *connectionMock) initConnectionMock(url string, timeout time.Duration) (Connection, error) {
+func (c *connectionMock) initConnectionMock(ctx context.Context, url string, timeout time.Duration) (Connection, error) {
 	c.closed = make(chan struct{})
 	c.reply = make(chan struct{}, 64)
 	return c, nil
@@ -170,7 +180,6 @@ func newTestCentrifugeImpl(url, project string, creds *Credentials, events *Even
 		closed:      make(chan struct{}),
 		waiters:     make(map[string]chan response),
 		events:      events,
-		reconnect:   true,
 
 		project:          libcentrifugo.ProjectKey(project),
 		wgworkers:        sync.WaitGroup{},
@@ -389,3 +398,1932 @@ func jsonMessage(t *testing.T, msg string, positive bool) error {
 
 	return what
 }
+
+func TestPublishContextCanceled(t *testing.T) {
+	c := newTestCentrifugeImpl(url, project, testCredentials(), nil, DefaultConfig, connectionMock{})
+	err := c.Connect()
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+
+	sub, err := c.Subscribe("channel", nil)
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+
+	// Mock never replies on publish so only ctx can release the caller.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = sub.PublishContext(ctx, []byte(`{}`))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error '%v'", err)
+	}
+
+	c.waitersMutex.RLock()
+	numWaiters := len(c.waiters)
+	c.waitersMutex.RUnlock()
+	if numWaiters != 0 {
+		t.Errorf("Waiter was not removed, %d left", numWaiters)
+	}
+}
+
+func TestRecoverAfterReconnect(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		ReconnectStrategy:    &PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond},
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), &EventHandler{
+		OnDisconnect: func(Centrifuge) error {
+			// Published while client is disconnected.
+			s.Publish("channel", []byte(`"missed1"`))
+			s.Publish("channel", []byte(`"missed2"`))
+			return nil
+		},
+	}, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	// Channel has history but client receives nothing before disconnect.
+	s.Publish("channel", []byte(`"old"`))
+	received := make(chan string, 10)
+	recovered := make(chan bool, 1)
+	_, err = c.Subscribe("channel", &SubEventHandler{
+		OnMessage: func(sub *Sub, msg libcentrifugo.Message) error {
+			received <- string(*msg.Data)
+			return nil
+		},
+		OnRecovered: func(sub *Sub, ok bool) error {
+			recovered <- ok
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	s.DropConnections()
+	select {
+	case ok := <-recovered:
+		if !ok {
+			t.Error("Messages must be recovered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnRecovered not called")
+	}
+	for _, expected := range []string{`"missed1"`, `"missed2"`} {
+		select {
+		case data := <-received:
+			if data != expected {
+				t.Errorf("Expected %s, got %s", expected, data)
+			}
+		default:
+			t.Fatalf("Message %s not recovered", expected)
+		}
+	}
+	if len(received) != 0 {
+		t.Errorf("Unexpected message %s", <-received)
+	}
+}
+
+func TestRecoverOrder(t *testing.T) {
+	var received []libcentrifugo.MessageID
+	sub := &Sub{
+		Channel: "channel",
+		events: &SubEventHandler{
+			OnMessage: func(sub *Sub, msg libcentrifugo.Message) error {
+				received = append(received, msg.UID)
+				return nil
+			},
+		},
+		recovering: true,
+	}
+
+	// Live messages which arrived while subscribe request was in flight.
+	sub.handleMessage(libcentrifugo.Message{UID: "3"})
+	sub.handleMessage(libcentrifugo.Message{UID: "4"})
+	if len(received) != 0 {
+		t.Fatal("Messages must be held back while recovering")
+	}
+
+	lastMessageID := libcentrifugo.MessageID("1")
+	missed := []libcentrifugo.Message{{UID: "3"}, {UID: "2"}, {UID: "1"}}
+	sub.recover(&lastMessageID, missed)
+
+	expected := []libcentrifugo.MessageID{"2", "3", "4"}
+	if len(received) != len(expected) {
+		t.Fatalf("Unexpected messages %v", received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Fatalf("Unexpected messages %v", received)
+		}
+	}
+	if *sub.lastMessageID != "4" {
+		t.Errorf("Unexpected last message ID %s", *sub.lastMessageID)
+	}
+}
+
+func TestPublishAsync(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		MaxPublishInFlight:   4,
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	numPublish := 20
+	received := make(chan libcentrifugo.Message, numPublish)
+	sub, err := c.Subscribe("channel", &SubEventHandler{
+		OnMessage: func(sub *Sub, msg libcentrifugo.Message) error {
+			received <- msg
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	results := make(chan error, numPublish)
+	for i := 0; i < numPublish; i++ {
+		sub.PublishAsync([]byte(strconv.Itoa(i)), func(err error) {
+			results <- err
+		})
+	}
+
+	for i := 0; i < numPublish; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Errorf("Unexpected error '%s'", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Publish result not received")
+		}
+		select {
+		case msg := <-received:
+			if string(*msg.Data) != strconv.Itoa(i) {
+				t.Errorf("Unexpected message order, got %s at %d", *msg.Data, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Published message not received")
+		}
+	}
+}
+
+func TestPublishAsyncDisconnected(t *testing.T) {
+	c := NewCentrifuge(url, project, testCredentials(), nil, DefaultConfig).(*centrifugeImpl)
+	sub := c.newSub("channel", nil)
+
+	// done is not called inline, caller may hold lock done needs.
+	var mutex sync.Mutex
+	numPublish := 100
+	results := make(chan error, numPublish)
+	mutex.Lock()
+	for i := 0; i < numPublish; i++ {
+		sub.PublishAsync([]byte(`{}`), func(err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			results <- err
+		})
+	}
+	mutex.Unlock()
+
+	for i := 0; i < numPublish; i++ {
+		select {
+		case err := <-results:
+			if err != ErrClientDisconnected {
+				t.Errorf("Unexpected error '%v'", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Publish result not received")
+		}
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		WriteBatchSize:       2,
+	}
+	c := newTestCentrifugeImpl(url, project, testCredentials(), nil, config, connectionMock{})
+
+	c.write <- []byte(`{"uid":"2"}`)
+	c.write <- []byte(`{"uid":"3"}`)
+	frame := c.batch([]byte(`{"uid":"1"}`))
+	if string(frame) != `[{"uid":"1"},{"uid":"2"}]` {
+		t.Errorf("Unexpected frame %s", frame)
+	}
+
+	frame = c.batch(<-c.write)
+	if string(frame) != `{"uid":"3"}` {
+		t.Errorf("Unexpected frame %s", frame)
+	}
+}
+
+func TestWriteBatchWindow(t *testing.T) {
+	window := 200 * time.Millisecond
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		WriteBatchSize:       3,
+		WriteBatchWindow:     window,
+	}
+	c := newTestCentrifugeImpl(url, project, testCredentials(), nil, config, connectionMock{})
+	wait := make(chan response, 1)
+	err := c.addWaiter("7", wait)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	start := time.Now()
+	frames := make(chan []byte, 1)
+	go func() {
+		frames <- c.batch([]byte(`{"uid":"1"}`))
+	}()
+
+	// Reply received while window is open is not delayed by it.
+	c.receive <- []byte(`{"uid":"7","method":"publish","body":{"status":true}}`)
+	select {
+	case <-wait:
+		if time.Since(start) >= window {
+			t.Error("Reply delayed by write batch window")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reply not handled")
+	}
+
+	c.write <- []byte(`{"uid":"2"}`)
+	frame := <-frames
+	if string(frame) != `[{"uid":"1"},{"uid":"2"}]` {
+		t.Errorf("Unexpected frame %s", frame)
+	}
+	if time.Since(start) < window {
+		t.Error("Frame sent before window ended")
+	}
+}
+
+func TestSubscribeMany(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	results := c.SubscribeMany(map[string]*SubEventHandler{
+		"channel1": nil,
+		"channel2": nil,
+		"$private": nil,
+	})
+	if len(results) != 3 {
+		t.Fatalf("Unexpected results %v", results)
+	}
+	for _, channel := range []string{"channel1", "channel2"} {
+		if results[channel].Err != nil || results[channel].Sub == nil {
+			t.Errorf("Unexpected result for %s: %v", channel, results[channel])
+		}
+	}
+	if results["$private"].Err == nil {
+		t.Error("Private channel without sign handler should fail")
+	}
+	if c.(*centrifugeImpl).subscribed("$private") {
+		t.Error("Failed subscription must be removed")
+	}
+
+	_, err = c.Subscribe("channel1", nil)
+	if err != ErrAlreadySubscribed {
+		t.Errorf("Unexpected error '%v'", err)
+	}
+	if !c.(*centrifugeImpl).subscribed("channel1") || results["channel1"].Sub.State() != SubSubscribed {
+		t.Error("Existing subscription must be kept")
+	}
+}
+
+func TestSubscribeManyTimeout(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              100 * time.Millisecond,
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	s.SetUnresponsive(true)
+	channels := make(map[string]*SubEventHandler)
+	for i := 0; i < 10; i++ {
+		channels["channel"+strconv.Itoa(i)] = nil
+	}
+	start := time.Now()
+	results := c.SubscribeMany(channels)
+	// Replies share one deadline instead of Timeout each.
+	if elapsed := time.Since(start); elapsed > 5*config.Timeout {
+		t.Errorf("SubscribeMany took %s", elapsed)
+	}
+	for channel, result := range results {
+		if !errors.Is(result.Err, ErrTimeout) {
+			t.Errorf("Unexpected result for %s: '%v'", channel, result.Err)
+		}
+	}
+}
+
+func TestStateChange(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	changes := make(chan string, 8)
+	events := &EventHandler{
+		OnStateChange: func(c Centrifuge, oldStatus, newStatus Status) {
+			changes <- oldStatus.String() + "->" + newStatus.String()
+		},
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), events, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	if c.Status() != CONNECTED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+	c.Close()
+	if c.Status() != CLOSED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+
+	expected := []string{"disconnected->connected", "connected->closing", "closing->closed"}
+	for _, e := range expected {
+		select {
+		case change := <-changes:
+			if change != e {
+				t.Errorf("Expected %s but got %s", e, change)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("State change %s not reported", e)
+		}
+	}
+}
+
+func TestAutoReconnect(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		Reconnect:            true,
+		ReconnectStrategy:    &PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond},
+	}
+	reconnected := make(chan struct{}, 1)
+	events := &EventHandler{
+		OnReconnected: func(Centrifuge) {
+			reconnected <- struct{}{}
+		},
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), events, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	received := make(chan libcentrifugo.Message, 1)
+	_, err = c.Subscribe("channel", &SubEventHandler{
+		OnMessage: func(sub *Sub, msg libcentrifugo.Message) error {
+			received <- msg
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	s.DropConnections()
+
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Client not reconnected")
+	}
+	if c.Status() != CONNECTED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+
+	s.Publish("channel", []byte(`{}`))
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("Channel not resubscribed")
+	}
+}
+
+func TestServerDisconnectMessage(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		Reconnect:            true,
+		ReconnectStrategy:    &PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond},
+	}
+	reconnected := make(chan struct{}, 1)
+	c := NewCentrifuge(s.URL, project, testCredentials(), &EventHandler{
+		OnReconnected: func(Centrifuge) {
+			reconnected <- struct{}{}
+		},
+	}, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	s.Disconnect("shutdown", true)
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client not reconnected")
+	}
+	if c.Status() != CONNECTED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+
+	s.Disconnect("banned", false)
+	deadline := time.After(5 * time.Second)
+	for c.Status() != CLOSED {
+		select {
+		case <-reconnected:
+			t.Fatal("Client must not reconnect")
+		case <-deadline:
+			t.Fatalf("Client not closed, status %s", c.Status())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestReconnectConnected(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	err = c.Reconnect(DefaultPeriodicReconnect)
+	if err != ErrClientStatus {
+		t.Errorf("Unexpected error '%v'", err)
+	}
+	if c.Status() != CONNECTED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+	if s.NumClients() != 1 {
+		t.Errorf("Expected 1 client, got %d", s.NumClients())
+	}
+}
+
+func TestResubscribeFailedStatus(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              100 * time.Millisecond,
+		ReconnectStrategy:    &PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond, NumReconnect: 2},
+	}
+	changes := make(chan Status, 32)
+	c := NewCentrifuge(s.URL, project, testCredentials(), &EventHandler{
+		OnStateChange: func(c Centrifuge, oldStatus, newStatus Status) {
+			changes <- newStatus
+		},
+	}, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+	if status := <-changes; status != CONNECTED {
+		t.Fatalf("Unexpected status %s", status)
+	}
+	_, err = c.Subscribe("channel", nil)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	// Resubscribe times out on every attempt until strategy gives up.
+	s.SetDelay("subscribe", 300*time.Millisecond)
+	s.DropConnections()
+	for {
+		select {
+		case status := <-changes:
+			if status == CONNECTED {
+				t.Fatal("Client must not be connected before resubscribe")
+			}
+			if c.Status() == CONNECTED {
+				t.Fatal("Client must not be connected before resubscribe")
+			}
+			if status != DISCONNECTED {
+				continue
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Reconnect did not give up, status %s", c.Status())
+		}
+		if c.Status() == DISCONNECTED {
+			break
+		}
+	}
+
+	s.SetDelay("subscribe", 0)
+	err = c.Reconnect(&PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	if c.Status() != CONNECTED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+}
+
+func TestReconnectClosed(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	c.Close()
+
+	err = c.Reconnect(&PeriodicReconnect{ReconnectInterval: time.Millisecond})
+	if err != ErrClientStatus {
+		t.Errorf("Unexpected error '%v'", err)
+	}
+	if c.Status() != CLOSED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+}
+
+type failingWriteConnection struct {
+	Connection
+	fail *atomic.Bool
+}
+
+func (c failingWriteConnection) WriteMessage(msg []byte) error {
+	if c.fail.Load() {
+		return errors.New("write failed")
+	}
+	return c.Connection.WriteMessage(msg)
+}
+
+func TestWriteErrorReconnects(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	var fail atomic.Bool
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              100 * time.Millisecond,
+		ReconnectStrategy:    &PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond},
+		ConnectionFactory: func(ctx context.Context, url string, writeTimeout time.Duration) (Connection, error) {
+			conn, err := NewWSConnection(ctx, url, writeTimeout)
+			if err != nil {
+				return nil, err
+			}
+			return failingWriteConnection{Connection: conn, fail: &fail}, nil
+		},
+	}
+	reconnected := make(chan struct{}, 1)
+	c := NewCentrifuge(s.URL, project, testCredentials(), &EventHandler{
+		OnReconnecting: func(Centrifuge) {
+			fail.Store(false)
+		},
+		OnReconnected: func(Centrifuge) {
+			reconnected <- struct{}{}
+		},
+	}, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+	sub, err := c.Subscribe("channel", nil)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	fail.Store(true)
+	if sub.Publish([]byte(`{}`)) == nil {
+		t.Error("Publish must fail")
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Client not reconnected, status %s", c.Status())
+	}
+	if c.Status() != CONNECTED || sub.State() != SubSubscribed {
+		t.Errorf("Unexpected status %s, sub state %s", c.Status(), sub.State())
+	}
+}
+
+func TestReconnectStrategies(t *testing.T) {
+	schedule := &ScheduleReconnect{Schedule: []time.Duration{time.Millisecond, time.Second}}
+	if d, ok := schedule.NextDelay(2, nil); !ok || d != time.Second {
+		t.Errorf("Unexpected delay %s", d)
+	}
+	if _, ok := schedule.NextDelay(3, nil); ok {
+		t.Error("Schedule should be exhausted")
+	}
+	schedule.RepeatLast = true
+	if d, ok := schedule.NextDelay(3, nil); !ok || d != time.Second {
+		t.Errorf("Unexpected delay %s", d)
+	}
+
+	jitter := &DecorrelatedJitterReconnect{NumReconnect: 100, Base: time.Millisecond, Max: time.Second}
+	for attempt := 1; attempt <= 100; attempt++ {
+		d, ok := jitter.NextDelay(attempt, nil)
+		if !ok || d < jitter.Base || d > jitter.Max {
+			t.Fatalf("Unexpected delay %s for attempt %d", d, attempt)
+		}
+	}
+	if _, ok := jitter.NextDelay(101, nil); ok {
+		t.Error("Reconnect attempts should be exhausted")
+	}
+
+	exponential := &BackoffReconnect{Min: time.Millisecond, Max: 4 * time.Millisecond, Factor: 2}
+	expected := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond}
+	for i, e := range expected {
+		if d, _ := exponential.NextDelay(i+1, nil); d != e {
+			t.Errorf("Expected %s but got %s for attempt %d", e, d, i+1)
+		}
+	}
+}
+
+func TestDeadConnectionDetected(t *testing.T) {
+	configs := map[string]*Config{
+		"protocol": {
+			PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+			Timeout:              50 * time.Millisecond,
+			PingInterval:         20 * time.Millisecond,
+		},
+		"websocket": {
+			PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+			Timeout:              DefaultTimeout,
+			ConnectionFactory:    NewWSHeartbeatFactory(20*time.Millisecond, 50*time.Millisecond),
+		},
+	}
+	for name, config := range configs {
+		s := centrifugetest.NewServer()
+
+		disconnected := make(chan struct{})
+		events := &EventHandler{
+			OnDisconnect: func(Centrifuge) error {
+				close(disconnected)
+				return nil
+			},
+		}
+		c := NewCentrifuge(s.URL, project, testCredentials(), events, config)
+		err := c.Connect()
+		if err != nil {
+			t.Fatalf("%s: should pass but error is '%s'", name, err)
+		}
+
+		s.SetUnresponsive(true)
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second):
+			t.Errorf("%s: dead connection not detected", name)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestDefaultPongWait(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	disconnected := make(chan struct{}, 1)
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		ConnectionFactory:    NewWSConnectionFactory(&WSConfig{PingInterval: 20 * time.Millisecond}),
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), &EventHandler{
+		OnDisconnect: func(Centrifuge) error {
+			disconnected <- struct{}{}
+			return nil
+		},
+	}, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	select {
+	case <-disconnected:
+		t.Fatal("Connection without PongWait must be kept alive")
+	case <-time.After(200 * time.Millisecond):
+	}
+	_, err = c.Subscribe("channel", nil)
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+}
+
+func TestWSConfigHeader(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		ConnectionFactory: NewWSConnectionFactory(&WSConfig{
+			Header: http.Header{"Cookie": []string{"session=1"}},
+		}),
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	handshakes := s.Handshakes()
+	if len(handshakes) != 1 || handshakes[0].Get("Cookie") != "session=1" {
+		t.Errorf("Unexpected handshakes %v", handshakes)
+	}
+}
+
+func TestSockJSFallback(t *testing.T) {
+	for _, transport := range []string{SockJSXHRStreaming, SockJSXHRPolling} {
+		t.Run(transport, func(t *testing.T) {
+			s := centrifugetest.NewServer()
+			defer s.Close()
+			s.SetWebsocketDisabled(true)
+
+			config := &Config{
+				PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+				Timeout:              DefaultTimeout,
+				ConnectionFactory: NewFallbackConnectionFactory(
+					NewWSConnection,
+					NewSockJSConnectionFactory(&SockJSConfig{Transports: []string{transport}}),
+				),
+			}
+			c := NewCentrifuge(s.URL, project, testCredentials(), nil, config)
+			err := c.Connect()
+			if err != nil {
+				t.Fatalf("Should pass but error is '%s'", err)
+			}
+			defer c.Close()
+
+			received := make(chan string, 2)
+			events := &SubEventHandler{
+				OnMessage: func(sub *Sub, msg libcentrifugo.Message) error {
+					received <- string(*msg.Data)
+					return nil
+				},
+			}
+			sub, err := c.Subscribe("channel", events)
+			if err != nil {
+				t.Fatalf("Should pass but error is '%s'", err)
+			}
+			err = sub.Publish([]byte(`"client"`))
+			if err != nil {
+				t.Errorf("Should pass but error is '%s'", err)
+			}
+			s.Publish("channel", []byte(`"server"`))
+
+			for _, expected := range []string{`"client"`, `"server"`} {
+				select {
+				case data := <-received:
+					if data != expected {
+						t.Errorf("Expected %s, got %s", expected, data)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Message %s not received", expected)
+				}
+			}
+		})
+	}
+}
+
+func TestCodec(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			s := centrifugetest.NewServer()
+			defer s.Close()
+
+			config := &Config{
+				PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+				Timeout:              DefaultTimeout,
+				WriteBatchSize:       8,
+				Codec:                codec,
+			}
+			c := NewCentrifuge(s.URL, project, testCredentials(), nil, config)
+			err := c.Connect()
+			if err != nil {
+				t.Fatalf("Should pass but error is '%s'", err)
+			}
+			defer c.Close()
+
+			received := make(chan string, 1)
+			events := &SubEventHandler{
+				OnMessage: func(sub *Sub, msg libcentrifugo.Message) error {
+					received <- string(*msg.Data)
+					return nil
+				},
+			}
+			results := c.SubscribeMany(map[string]*SubEventHandler{"a": events, "b": nil})
+			for channel, result := range results {
+				if result.Err != nil {
+					t.Fatalf("Subscribe on %s should pass but error is '%s'", channel, result.Err)
+				}
+			}
+			err = results["a"].Sub.Publish([]byte(`{"value":1}`))
+			if err != nil {
+				t.Errorf("Should pass but error is '%s'", err)
+			}
+			select {
+			case data := <-received:
+				if data != `{"value":1}` {
+					t.Errorf("Unexpected data %s", data)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Message not received")
+			}
+
+			history, err := results["a"].Sub.History()
+			if err != nil {
+				t.Errorf("Should pass but error is '%s'", err)
+			}
+			if len(history) != 1 {
+				t.Errorf("Unexpected history %v", history)
+			}
+			presence, err := results["a"].Sub.Presence()
+			if err != nil {
+				t.Errorf("Should pass but error is '%s'", err)
+			}
+			if _, ok := presence[libcentrifugo.ConnID(c.ClientID())]; !ok {
+				t.Errorf("Unexpected presence %v", presence)
+			}
+		})
+	}
+}
+
+func TestBinaryCodecRequiresBinaryConnection(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		Codec:                MsgpackCodec,
+		ConnectionFactory:    NewSockJSConnectionFactory(&SockJSConfig{}),
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, config)
+	err := c.Connect()
+	if err != ErrBinaryNotSupported {
+		t.Errorf("Unexpected error '%v'", err)
+	}
+}
+
+func TestSockJSHandshakeTimeout(t *testing.T) {
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+
+	factory := NewSockJSConnectionFactory(&SockJSConfig{
+		URL:              stalled.URL,
+		Transports:       []string{SockJSXHRStreaming},
+		HandshakeTimeout: 50 * time.Millisecond,
+	})
+	start := time.Now()
+	_, err := factory(context.Background(), stalled.URL, DefaultTimeout)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got '%v'", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Handshake took %s", elapsed)
+	}
+}
+
+func TestSubscribeTyped(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	type event struct {
+		Name  string `json:"name"`
+		Value int    `json:"value"`
+	}
+	received := make(chan event, 1)
+	decodeErrors := make(chan error, 1)
+	subscribed := make(chan struct{}, 1)
+	sub, err := SubscribeTyped(c, "events", &TypedSubEventHandler[event]{
+		SubEventHandler: SubEventHandler{
+			OnSubscribeSuccess: func(sub *Sub) error {
+				subscribed <- struct{}{}
+				return nil
+			},
+		},
+		OnMessage: func(sub *TypedSub[event], data event, msg libcentrifugo.Message) error {
+			if msg.Channel != "events" {
+				t.Errorf("Unexpected channel %s", msg.Channel)
+			}
+			received <- data
+			return nil
+		},
+		OnDecodeError: func(sub *Sub, msg libcentrifugo.Message, err error) {
+			decodeErrors <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	select {
+	case <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Embedded handler not called")
+	}
+
+	err = sub.Publish(event{Name: "a", Value: 1})
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+	select {
+	case data := <-received:
+		if data != (event{Name: "a", Value: 1}) {
+			t.Errorf("Unexpected data %v", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+
+	s.Publish("events", []byte(`"not an object"`))
+	select {
+	case <-decodeErrors:
+	case data := <-received:
+		t.Errorf("Message must not be decoded, got %v", data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Decode error not reported")
+	}
+}
+
+func TestSubChannels(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+	s.JoinLeave = true
+
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	sub, err := c.Subscribe("channel", nil)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	messages := sub.Messages()
+	events := sub.Events()
+
+	s.Publish("channel", []byte(`1`))
+	s.Publish("channel", []byte(`2`))
+	for _, expected := range []string{"1", "2"} {
+		select {
+		case msg := <-messages:
+			if string(*msg.Data) != expected {
+				t.Errorf("Expected %s, got %s", expected, *msg.Data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+
+	err = sub.Unsubscribe()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	for range messages {
+	}
+	var types []SubEventType
+	for event := range events {
+		types = append(types, event.Type)
+	}
+	expected := []SubEventType{SubEventMessage, SubEventMessage, SubEventUnsubscribe}
+	if len(types) != len(expected) {
+		t.Fatalf("Unexpected events %v", types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("Unexpected events %v", types)
+		}
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	cases := []struct {
+		policy   OverflowPolicy
+		ok       bool
+		expected []int
+	}{
+		{OverflowDropOldest, true, []int{2, 3}},
+		{OverflowDropNewest, true, []int{1, 2}},
+		{OverflowDisconnect, false, []int{1, 2}},
+	}
+	for _, tc := range cases {
+		ch := make(chan int, 2)
+		ch <- 1
+		ch <- 2
+		dropped := 0
+		ok := send(ch, 3, tc.policy, nil, func() { dropped++ })
+		if ok != tc.ok {
+			t.Errorf("Policy %d: unexpected result %v", tc.policy, ok)
+		}
+		if dropped != 1 {
+			t.Errorf("Policy %d: unexpected dropped count %d", tc.policy, dropped)
+		}
+		close(ch)
+		var values []int
+		for v := range ch {
+			values = append(values, v)
+		}
+		if len(values) != len(tc.expected) || values[0] != tc.expected[0] || values[1] != tc.expected[1] {
+			t.Errorf("Policy %d: unexpected values %v", tc.policy, values)
+		}
+	}
+
+	ch := make(chan int)
+	done := make(chan struct{})
+	close(done)
+	if !send(ch, 1, OverflowBlock, done, func() { t.Error("Blocked send must not drop") }) {
+		t.Error("Blocked send must be released by done")
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		ReconnectStrategy:    &PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond},
+		SubBufferSize:        1,
+		SubOverflowPolicy:    OverflowDisconnect,
+	}
+	reconnecting := make(chan struct{}, 1)
+	events := &EventHandler{
+		OnReconnecting: func(Centrifuge) {
+			select {
+			case reconnecting <- struct{}{}:
+			default:
+			}
+		},
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), events, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	sub, err := c.Subscribe("channel", nil)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	messages := sub.Messages()
+
+	for i := 1; i <= 3; i++ {
+		s.Publish("channel", []byte(strconv.Itoa(i)))
+	}
+	select {
+	case <-reconnecting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection not dropped on overflow")
+	}
+
+	// Messages dropped on overflow are recovered after reconnect.
+	for i := 1; i <= 3; i++ {
+		select {
+		case msg := <-messages:
+			if string(*msg.Data) != strconv.Itoa(i) {
+				t.Fatalf("Expected %d, got %s", i, *msg.Data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %d not received", i)
+		}
+	}
+}
+
+func TestOnUnsubscribe(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	reasons := make(chan UnsubscribeReason, 3)
+	events := &SubEventHandler{
+		OnUnsubscribe: func(sub *Sub, reason UnsubscribeReason) error {
+			reasons <- reason
+			return nil
+		},
+	}
+	subs := map[string]*Sub{}
+	for _, channel := range []string{"client", "server", "close"} {
+		sub, err := c.Subscribe(channel, events)
+		if err != nil {
+			t.Fatalf("Should pass but error is '%s'", err)
+		}
+		subs[channel] = sub
+	}
+
+	expectReason := func(expected UnsubscribeReason) {
+		select {
+		case reason := <-reasons:
+			if reason != expected {
+				t.Errorf("Expected %s, got %s", expected, reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnUnsubscribe not called for %s", expected)
+		}
+	}
+
+	err = subs["client"].Unsubscribe()
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+	expectReason(UnsubscribeClient)
+
+	events2 := subs["server"].Events()
+	s.Unsubscribe("server")
+	expectReason(UnsubscribeServer)
+	var last SubEvent
+	for event := range events2 {
+		last = event
+	}
+	if last.Type != SubEventUnsubscribe || last.Reason != UnsubscribeServer {
+		t.Errorf("Unexpected last event %v", last)
+	}
+
+	c.Close()
+	expectReason(UnsubscribeClose)
+
+	// Already removed subscriptions are not reported again.
+	err = subs["client"].Unsubscribe()
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+	select {
+	case reason := <-reasons:
+		t.Errorf("Unexpected OnUnsubscribe with %s", reason)
+	default:
+	}
+	if c.(*centrifugeImpl).subscribed("client") || c.(*centrifugeImpl).subscribed("server") || c.(*centrifugeImpl).subscribed("close") {
+		t.Error("Subscriptions must be removed")
+	}
+}
+
+func TestSubState(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		Reconnect:            true,
+		ReconnectStrategy:    &PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond},
+	}
+	reconnected := make(chan struct{}, 1)
+	c := NewCentrifuge(s.URL, project, testCredentials(), &EventHandler{
+		OnReconnected: func(Centrifuge) {
+			reconnected <- struct{}{}
+		},
+	}, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	var mutex sync.Mutex
+	signErr := errors.New("sign failed")
+	var failSign bool
+	var successes, failures []string
+	events := &SubEventHandler{
+		OnPrivateSub: func(c Centrifuge, r *PrivateRequest) (*PrivateSign, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if failSign {
+				return nil, signErr
+			}
+			return &PrivateSign{Sign: "sign"}, nil
+		},
+		OnSubscribeSuccess: func(sub *Sub) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			successes = append(successes, sub.Channel)
+			return nil
+		},
+		OnSubscribeError: func(sub *Sub, err error) error {
+			// Client methods must not deadlock reconnect.
+			c.Status()
+			mutex.Lock()
+			defer mutex.Unlock()
+			failures = append(failures, sub.Channel)
+			return nil
+		},
+	}
+	// Handlers run on dispatch goroutine, wait for them.
+	waitHandlers := func(f func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mutex.Lock()
+			ok := f()
+			mutex.Unlock()
+			if ok || time.Now().After(deadline) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	public, err := c.Subscribe("public", events)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	private, err := c.Subscribe("$private", events)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	if public.State() != SubSubscribed || private.State() != SubSubscribed {
+		t.Fatalf("Unexpected states %s, %s", public.State(), private.State())
+	}
+
+	mutex.Lock()
+	failSign = true
+	mutex.Unlock()
+	s.DropConnections()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client not reconnected")
+	}
+
+	// Failed private channel does not break connection and other channels.
+	if c.Status() != CONNECTED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+	if public.State() != SubSubscribed {
+		t.Errorf("Unexpected public state %s", public.State())
+	}
+	if private.State() != SubFailed || private.Err() != signErr {
+		t.Errorf("Unexpected private state %s, error %v", private.State(), private.Err())
+	}
+	waitHandlers(func() bool { return len(failures) > 0 })
+	mutex.Lock()
+	if len(failures) != 1 || failures[0] != "$private" {
+		t.Errorf("Unexpected failures %v", failures)
+	}
+	failSign = false
+	mutex.Unlock()
+
+	err = private.Resubscribe()
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+	if private.State() != SubSubscribed {
+		t.Errorf("Unexpected private state %s", private.State())
+	}
+	waitHandlers(func() bool { return len(successes) >= 4 })
+	mutex.Lock()
+	if len(successes) != 4 {
+		t.Errorf("Unexpected successes %v", successes)
+	}
+	mutex.Unlock()
+
+	err = public.Unsubscribe()
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+	if public.State() != SubUnsubscribed {
+		t.Errorf("Unexpected public state %s", public.State())
+	}
+}
+
+func TestRefreshExpiredClose(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+	s.TTL = 1
+
+	closed := make(chan struct{})
+	events := &EventHandler{
+		OnRefresh: func(Centrifuge) (*Credentials, error) {
+			return testCredentials(), nil
+		},
+		OnError: func(c Centrifuge, err error) {
+			c.Close()
+			close(closed)
+		},
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), events, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	s.SetExpired(true)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client not closed from OnError")
+	}
+	if c.Status() != CLOSED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+}
+
+func TestRefreshLoop(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+	s.TTL = 1
+
+	var mutex sync.Mutex
+	calls := 0
+	errs := make(chan error, 1)
+	events := &EventHandler{
+		OnRefresh: func(Centrifuge) (*Credentials, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			calls++
+			if calls == 1 {
+				return nil, errors.New("credentials service unavailable")
+			}
+			return testCredentials(), nil
+		},
+		OnError: func(c Centrifuge, err error) {
+			errs <- err
+		},
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), events, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	refreshes := func() int {
+		n := 0
+		for _, cmd := range s.Commands() {
+			if cmd.Method == "refresh" {
+				n++
+			}
+		}
+		return n
+	}
+	// First refresh fails and is retried, then loop is re-armed.
+	deadline := time.Now().Add(5 * time.Second)
+	for refreshes() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 refreshes, got %d", refreshes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.Status() != CONNECTED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+
+	s.SetExpired(true)
+	select {
+	case err := <-errs:
+		if err != ErrClientExpired {
+			t.Errorf("Unexpected error '%v'", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expired refresh not reported")
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for c.Status() != DISCONNECTED {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected status %s", c.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrivateSignProvider(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	var mutex sync.Mutex
+	var calls [][]string
+	provider := PrivateSignProviderFunc(func(ctx context.Context, clientID string, channels []string) (map[string]*PrivateSign, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls = append(calls, channels)
+		signs := make(map[string]*PrivateSign)
+		for _, channel := range channels {
+			if channel != "$unknown" {
+				signs[channel] = &PrivateSign{Sign: "sign-" + clientID}
+			}
+		}
+		return signs, nil
+	})
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		Reconnect:            true,
+		ReconnectStrategy:    &PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond},
+		PrivateSignProvider:  provider,
+	}
+	reconnected := make(chan struct{}, 1)
+	c := NewCentrifuge(s.URL, project, testCredentials(), &EventHandler{
+		OnReconnected: func(Centrifuge) {
+			reconnected <- struct{}{}
+		},
+	}, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	numCalls := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(calls)
+	}
+
+	results := c.SubscribeMany(map[string]*SubEventHandler{"$a": nil, "$b": nil, "$unknown": nil})
+	if results["$a"].Err != nil || results["$b"].Err != nil {
+		t.Fatalf("Unexpected results %v", results)
+	}
+	if results["$unknown"].Err != ErrPrivateSignMissing {
+		t.Errorf("Unexpected error '%v'", results["$unknown"].Err)
+	}
+	if numCalls() != 1 || len(calls[0]) != 3 {
+		t.Fatalf("Expected one call for all channels, got %v", calls)
+	}
+
+	// Cached sign is used for the same client ID.
+	err = results["$a"].Sub.Unsubscribe()
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+	_, err = c.Subscribe("$a", nil)
+	if err != nil {
+		t.Errorf("Should pass but error is '%s'", err)
+	}
+	if numCalls() != 1 {
+		t.Errorf("Expected cached sign, got %v", calls)
+	}
+
+	// New client ID after reconnect invalidates cache.
+	s.DropConnections()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client not reconnected")
+	}
+	if numCalls() != 2 || len(calls[1]) != 2 {
+		t.Errorf("Expected one call for resubscribed channels, got %v", calls)
+	}
+}
+
+func TestSlowHandler(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              time.Second,
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	release := make(chan struct{})
+	slow := make(chan string, 2)
+	_, err = c.Subscribe("slow", &SubEventHandler{
+		OnMessage: func(sub *Sub, msg libcentrifugo.Message) error {
+			<-release
+			slow <- string(*msg.Data)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	fast := make(chan struct{}, 1)
+	sub, err := c.Subscribe("fast", &SubEventHandler{
+		OnMessage: func(sub *Sub, msg libcentrifugo.Message) error {
+			fast <- struct{}{}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	s.Publish("slow", []byte(`1`))
+	s.Publish("slow", []byte(`2`))
+	err = sub.Publish([]byte(`{}`))
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	select {
+	case <-fast:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message of other channel not received")
+	}
+
+	close(release)
+	for _, expected := range []string{"1", "2"} {
+		select {
+		case data := <-slow:
+			if data != expected {
+				t.Errorf("Expected %s, got %s", expected, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+}
+
+func TestDispatchOverflow(t *testing.T) {
+	cases := []struct {
+		policy   OverflowPolicy
+		expected string
+	}{
+		{OverflowDropOldest, "b"},
+		{OverflowDropNewest, "a"},
+		{OverflowDisconnect, "a"},
+		// Blocking is not supported, run goroutine must not wait.
+		{OverflowBlock, "a"},
+	}
+	for _, tc := range cases {
+		c := &centrifugeImpl{config: &Config{DispatchQueueSize: 1, DispatchOverflowPolicy: tc.policy}}
+		sub := &Sub{centrifuge: c, Channel: "channel"}
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		sub.dispatch(func() {
+			close(started)
+			<-release
+		}, true)
+		<-started
+
+		handled := make(chan string, 2)
+		sub.dispatch(func() { handled <- "a" }, true)
+		sub.dispatch(func() { handled <- "b" }, true)
+		sub.dispatch(func() { close(handled) }, false)
+		close(release)
+
+		var values []string
+		for v := range handled {
+			values = append(values, v)
+		}
+		if len(values) != 1 || values[0] != tc.expected {
+			t.Errorf("Policy %d: unexpected values %v", tc.policy, values)
+		}
+	}
+}
+
+func TestHandlerErrorPolicy(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	errPoison := errors.New("poison message")
+	cases := []struct {
+		policy   HandlerErrorPolicy
+		calls    int
+		reported bool
+		state    SubState
+	}{
+		{HandlerErrorLog, 1, false, SubSubscribed},
+		{HandlerErrorReport, 1, true, SubSubscribed},
+		{HandlerErrorUnsubscribe, 1, false, SubUnsubscribed},
+		{HandlerErrorRetry, 3, true, SubSubscribed},
+	}
+	for _, tc := range cases {
+		reported := make(chan error, 1)
+		config := &Config{
+			PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+			Timeout:              DefaultTimeout,
+			HandlerErrorPolicy:   tc.policy,
+			HandlerRetries:       2,
+			HandlerRetryDelay:    time.Millisecond,
+		}
+		c := NewCentrifuge(s.URL, project, testCredentials(), &EventHandler{
+			OnError: func(c Centrifuge, err error) {
+				reported <- err
+			},
+		}, config)
+		err := c.Connect()
+		if err != nil {
+			t.Fatalf("Should pass but error is '%s'", err)
+		}
+
+		calls := make(chan struct{}, 10)
+		done := make(chan struct{})
+		var once sync.Once
+		sub, err := c.Subscribe("channel", &SubEventHandler{
+			OnMessage: func(sub *Sub, msg libcentrifugo.Message) error {
+				calls <- struct{}{}
+				if string(*msg.Data) == `"done"` {
+					once.Do(func() { close(done) })
+					return nil
+				}
+				return errPoison
+			},
+			OnUnsubscribe: func(sub *Sub, reason UnsubscribeReason) error {
+				once.Do(func() { close(done) })
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("Should pass but error is '%s'", err)
+		}
+		s.Publish("channel", []byte(`"poison"`))
+		s.Publish("channel", []byte(`"done"`))
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Policy %d: messages not handled", tc.policy)
+		}
+
+		if n := len(calls) - 1; tc.state == SubSubscribed && n != tc.calls {
+			t.Errorf("Policy %d: expected %d calls, got %d", tc.policy, tc.calls, n)
+		}
+		select {
+		case err := <-reported:
+			var herr *HandlerError
+			if !tc.reported || !errors.As(err, &herr) || !errors.Is(err, errPoison) || herr.Channel != "channel" {
+				t.Errorf("Policy %d: unexpected error '%v'", tc.policy, err)
+			}
+		default:
+			if tc.reported {
+				t.Errorf("Policy %d: error not reported", tc.policy)
+			}
+		}
+		if sub.State() != tc.state {
+			t.Errorf("Policy %d: unexpected state %s", tc.policy, sub.State())
+		}
+		c.Close()
+	}
+
+	// Subscribe handlers are covered by policy too.
+	reported := make(chan error, 1)
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              DefaultTimeout,
+		HandlerErrorPolicy:   HandlerErrorReport,
+	}
+	c := NewCentrifuge(s.URL, project, testCredentials(), &EventHandler{
+		OnError: func(c Centrifuge, err error) {
+			reported <- err
+		},
+	}, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+	_, err = c.Subscribe("channel", &SubEventHandler{
+		OnSubscribeSuccess: func(sub *Sub) error {
+			return errPoison
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	select {
+	case err := <-reported:
+		var herr *HandlerError
+		if !errors.As(err, &herr) || herr.Event != SubEventSubscribeSuccess || !errors.Is(err, errPoison) {
+			t.Errorf("Unexpected error '%v'", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Subscribe success handler error not reported")
+	}
+}
+
+func TestServerError(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	s.SetError("subscribe", centrifugetest.ErrPermissionDenied)
+	_, err = c.Subscribe("channel", nil)
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Expected ServerError, got '%v'", err)
+	}
+	if serr.Method != "subscribe" || serr.UID == "" || serr.Code != ServerErrorPermissionDenied || err.Error() != centrifugetest.ErrPermissionDenied {
+		t.Errorf("Unexpected error %+v", serr)
+	}
+	if !errors.Is(err, ErrPermissionDenied) || errors.Is(err, ErrNamespaceNotFound) {
+		t.Errorf("Error must match its code only")
+	}
+	if serr.Temporary() || IsRetryable(err) {
+		t.Errorf("Permission denied must not be retried")
+	}
+	s.SetError("subscribe", "")
+
+	sub, err := c.Subscribe("channel", nil)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	s.SetError("publish", "internal server error")
+	err = sub.Publish([]byte(`{}`))
+	if !errors.As(err, &serr) || !serr.Temporary() || serr.Retryable() {
+		t.Errorf("Publish must not be retried after internal error, got '%v'", err)
+	}
+	s.SetError("publish", "custom error")
+	err = sub.Publish([]byte(`{}`))
+	if !errors.As(err, &serr) || serr.Code != ServerErrorUnknown || serr.Message != "custom error" {
+		t.Errorf("Unexpected error '%v'", err)
+	}
+
+	if !IsRetryable(&ServerError{Method: "history", Code: ServerErrorInternal}) {
+		t.Error("History must be retried after internal error")
+	}
+	if !IsRetryable(fmt.Errorf("history: %w", ErrClientDisconnected)) || IsRetryable(context.Canceled) {
+		t.Error("Unexpected retry classification")
+	}
+
+	// Timed out publish may have been applied by server.
+	config := &Config{
+		PrivateChannelPrefix: DefaultPrivateChannelPrefix,
+		Timeout:              50 * time.Millisecond,
+	}
+	c = NewCentrifuge(s.URL, project, testCredentials(), nil, config)
+	err = c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+	sub, err = c.Subscribe("timeout", nil)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	s.SetError("publish", "")
+	s.SetDelay("publish", 200*time.Millisecond)
+	err = sub.Publish([]byte(`{}`))
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected timeout, got '%v'", err)
+	}
+	if IsRetryable(err) {
+		t.Error("Timed out publish must not be retried")
+	}
+}
+
+func TestConnectContextCanceled(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	c := NewCentrifuge(s.URL, project, testCredentials(), nil, DefaultConfig)
+	s.SetDelay("connect", 200*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.ConnectContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got '%v'", err)
+	}
+	if c.Status() == CONNECTED {
+		t.Errorf("Unexpected status %s", c.Status())
+	}
+	// Connection of failed attempt is closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for s.NumClients() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no clients, got %d", s.NumClients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Canceled context aborts dial too.
+	err = c.ConnectContext(ctx)
+	if err == nil {
+		t.Fatal("Connect with canceled context must fail")
+	}
+
+	s.SetDelay("connect", 0)
+	err = c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+	if s.NumClients() != 1 {
+		t.Errorf("Expected 1 client, got %d", s.NumClients())
+	}
+}
+
+type logEntry struct {
+	level  LogLevel
+	msg    string
+	fields []interface{}
+}
+
+type captureLogger struct {
+	entries []logEntry
+}
+
+func (l *captureLogger) Log(level LogLevel, msg string, fields ...interface{}) {
+	l.entries = append(l.entries, logEntry{level: level, msg: msg, fields: fields})
+}
+
+func TestLogDebug(t *testing.T) {
+	logger := &captureLogger{}
+	c := &centrifugeImpl{config: &Config{Logger: logger}}
+	c.log(LogLevelDebug, "dropped")
+	c.log(LogLevelInfo, "passed", "key", "value")
+	if len(logger.entries) != 1 || logger.entries[0].msg != "passed" {
+		t.Fatalf("Debug entry must be dropped, got %v", logger.entries)
+	}
+	if logger.entries[0].level != LogLevelInfo || fmt.Sprint(logger.entries[0].fields) != "[key value]" {
+		t.Errorf("Unexpected entry %v", logger.entries[0])
+	}
+
+	c.config.Debug = true
+	c.log(LogLevelDebug, "passed")
+	if len(logger.entries) != 2 || logger.entries[1].level != LogLevelDebug {
+		t.Errorf("Debug entry must be passed, got %v", logger.entries)
+	}
+
+	// Nil logger is fine.
+	c = &centrifugeImpl{config: &Config{Debug: true}}
+	c.log(LogLevelError, "discarded")
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	levels := map[LogLevel]string{
+		LogLevelDebug: "DEBUG",
+		LogLevelInfo:  "INFO",
+		LogLevelWarn:  "WARN",
+		LogLevelError: "ERROR",
+	}
+	for level, expected := range levels {
+		buf.Reset()
+		logger.Log(level, "message", "channel", "news", "attempt", 2)
+		var entry map[string]interface{}
+		err := json.Unmarshal(buf.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("Should pass but error is '%s'", err)
+		}
+		if entry["level"] != expected || entry["msg"] != "message" {
+			t.Errorf("Unexpected entry for %s: %v", level, entry)
+		}
+		if entry["channel"] != "news" || entry["attempt"] != float64(2) {
+			t.Errorf("Unexpected fields for %s: %v", level, entry)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Package centrifugeotel traces centrifuge client commands with
+// OpenTelemetry.
+//
+//	config.Tracer = centrifugeotel.New(nil)
+//
+// Span is started for every command with context passed to client method,
+// so commands made with SubscribeContext, PublishContext and the like are
+// children of caller span.
+package centrifugeotel
+
+import (
+	"context"
+	"errors"
+
+	"github.com/shilkin/centrifuge-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName is instrumentation scope of spans.
+const ScopeName = "github.com/shilkin/centrifuge-go/centrifugeotel"
+
+// Span attributes.
+const (
+	MethodKey    = attribute.Key("centrifuge.method")
+	ChannelKey   = attribute.Key("centrifuge.channel")
+	ErrorCodeKey = attribute.Key("centrifuge.error_code")
+)
+
+// Tracer implements centrifuge.Tracer.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var _ centrifuge.Tracer = (*Tracer)(nil)
+
+// New creates Tracer with spans from provider, global provider is used
+// when nil.
+func New(provider trace.TracerProvider) *Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return &Tracer{tracer: provider.Tracer(ScopeName)}
+}
+
+// StartCommand starts client span named after method, e.g.
+// "centrifuge publish". Error of command sets span status.
+func (t *Tracer) StartCommand(ctx context.Context, method, channel string) func(error) {
+	attrs := []attribute.KeyValue{MethodKey.String(method)}
+	if channel != "" {
+		attrs = append(attrs, ChannelKey.String(channel))
+	}
+	_, span := t.tracer.Start(ctx, "centrifuge "+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	return func(err error) {
+		if err != nil {
+			var serr *centrifuge.ServerError
+			if errors.As(err, &serr) {
+				span.SetAttributes(ErrorCodeKey.String(serr.Code.String()))
+			}
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,99 @@
+package centrifugeotel_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shilkin/centrifuge-go"
+	"github.com/shilkin/centrifuge-go/centrifugeotel"
+	"github.com/shilkin/centrifuge-go/centrifugetest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	config := &centrifuge.Config{
+		PrivateChannelPrefix: centrifuge.DefaultPrivateChannelPrefix,
+		Timeout:              centrifuge.DefaultTimeout,
+		Tracer:               centrifugeotel.New(provider),
+	}
+	c := centrifuge.NewCentrifuge(s.URL, "project", &centrifuge.Credentials{
+		User:      "1",
+		Timestamp: centrifuge.Timestamp(),
+		Token:     "token",
+	}, nil, config)
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+	err := c.ConnectContext(ctx)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+	sub, err := c.SubscribeContext(ctx, "channel", nil)
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	s.SetError("publish", centrifugetest.ErrPermissionDenied)
+	err = sub.PublishContext(ctx, []byte(`{}`))
+	if err == nil {
+		t.Fatal("Publish must fail")
+	}
+	_, err = sub.History()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	parent.End()
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	for _, name := range []string{"centrifuge connect", "centrifuge subscribe", "centrifuge publish"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("Span %s not exported, got %v", name, spans)
+		}
+		if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("Span %s must be child of caller span", name)
+		}
+	}
+
+	history := spans["centrifuge history"]
+	if history.Parent.IsValid() {
+		t.Error("Span of call without context must be root")
+	}
+	if !hasAttribute(history.Attributes, centrifugeotel.ChannelKey.String("channel")) ||
+		!hasAttribute(history.Attributes, centrifugeotel.MethodKey.String("history")) {
+		t.Errorf("Unexpected attributes %v", history.Attributes)
+	}
+	if history.Status.Code == codes.Error {
+		t.Errorf("Unexpected status %v", history.Status)
+	}
+
+	publish := spans["centrifuge publish"]
+	if publish.Status.Code != codes.Error || publish.Status.Description != centrifugetest.ErrPermissionDenied {
+		t.Errorf("Unexpected status %v", publish.Status)
+	}
+	if !hasAttribute(publish.Attributes, centrifugeotel.ErrorCodeKey.String("permission denied")) {
+		t.Errorf("Unexpected attributes %v", publish.Attributes)
+	}
+	if hasAttribute(spans["centrifuge connect"].Attributes, centrifugeotel.ChannelKey.String("")) {
+		t.Error("Connect span must not have channel")
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, expected attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if attr == expected {
+			return true
+		}
+	}
+	return false
+}
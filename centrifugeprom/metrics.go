@@ -0,0 +1,157 @@
+// Package centrifugeprom exports centrifuge client metrics to Prometheus.
+//
+//	metrics := centrifugeprom.New(centrifugeprom.Opts{})
+//	prometheus.MustRegister(metrics)
+//	config.Metrics = metrics
+//
+// One Metrics can be shared by clients of process, counters and histograms
+// are summed then and queue depth gauges show value reported last.
+package centrifugeprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shilkin/centrifuge-go"
+)
+
+const DefaultNamespace = "centrifuge_client"
+
+// Opts configures metric names and labels.
+type Opts struct {
+	// Namespace prefixes metric names, DefaultNamespace when empty.
+	Namespace string
+	// ConstLabels are added to every metric, e.g. to tell clients apart.
+	ConstLabels prometheus.Labels
+	// Buckets of command latency histogram in seconds,
+	// prometheus.DefBuckets when not set.
+	Buckets []float64
+	// NoChannelLabel counts messages and drops without channel label, use
+	// it when number of channels is not bounded.
+	NoChannelLabel bool
+}
+
+// Metrics implements centrifuge.Metrics and prometheus.Collector.
+type Metrics struct {
+	commands       *prometheus.CounterVec
+	latency        *prometheus.HistogramVec
+	queueDepth     *prometheus.GaugeVec
+	reconnects     *prometheus.CounterVec
+	refreshes      *prometheus.CounterVec
+	messages       *prometheus.CounterVec
+	dropped        *prometheus.CounterVec
+	noChannelLabel bool
+}
+
+var _ centrifuge.Metrics = (*Metrics)(nil)
+
+// New creates Metrics, they must be registered to be exported.
+func New(opts Opts) *Metrics {
+	if opts.Namespace == "" {
+		opts.Namespace = DefaultNamespace
+	}
+	if opts.Buckets == nil {
+		opts.Buckets = prometheus.DefBuckets
+	}
+	var channelLabels []string
+	if !opts.NoChannelLabel {
+		channelLabels = []string{"channel"}
+	}
+	return &Metrics{
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        "commands_total",
+			Help:        "Number of commands sent by method and outcome.",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"method", "outcome"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Name:        "command_duration_seconds",
+			Help:        "Time from sending command until reply received.",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     opts.Buckets,
+		}, []string{"method"}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Name:        "queue_depth",
+			Help:        "Number of frames waiting in receive and write queues.",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"queue"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        "reconnects_total",
+			Help:        "Number of reconnect attempts by outcome.",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"outcome"}),
+		refreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        "refreshes_total",
+			Help:        "Number of credentials refreshes by outcome.",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"outcome"}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        "messages_total",
+			Help:        "Number of messages delivered to subscriptions.",
+			ConstLabels: opts.ConstLabels,
+		}, channelLabels),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        "dropped_total",
+			Help:        "Number of messages, join and leave events dropped by slow subscriptions.",
+			ConstLabels: opts.ConstLabels,
+		}, channelLabels),
+		noChannelLabel: opts.NoChannelLabel,
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.commands, m.latency, m.queueDepth, m.reconnects, m.refreshes, m.messages, m.dropped}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) ObserveCommand(method string, outcome centrifuge.Outcome, latency time.Duration) {
+	m.commands.WithLabelValues(method, string(outcome)).Inc()
+	m.latency.WithLabelValues(method).Observe(latency.Seconds())
+}
+
+func (m *Metrics) SetQueueDepth(queue string, depth int) {
+	m.queueDepth.WithLabelValues(queue).Set(float64(depth))
+}
+
+func (m *Metrics) IncReconnect(outcome centrifuge.Outcome) {
+	m.reconnects.WithLabelValues(string(outcome)).Inc()
+}
+
+func (m *Metrics) IncRefresh(outcome centrifuge.Outcome) {
+	m.refreshes.WithLabelValues(string(outcome)).Inc()
+}
+
+func (m *Metrics) IncMessage(channel string) {
+	if m.noChannelLabel {
+		m.messages.WithLabelValues().Inc()
+		return
+	}
+	m.messages.WithLabelValues(channel).Inc()
+}
+
+func (m *Metrics) IncDropped(channel string) {
+	if m.noChannelLabel {
+		m.dropped.WithLabelValues().Inc()
+		return
+	}
+	m.dropped.WithLabelValues(channel).Inc()
+}
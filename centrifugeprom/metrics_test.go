@@ -0,0 +1,107 @@
+package centrifugeprom_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shilkin/centrifuge-go"
+	"github.com/shilkin/centrifuge-go/centrifugeprom"
+	"github.com/shilkin/centrifuge-go/centrifugetest"
+	"github.com/shilkin/centrifugo/libcentrifugo"
+)
+
+func TestMetrics(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	metrics := centrifugeprom.New(centrifugeprom.Opts{})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics)
+
+	config := &centrifuge.Config{
+		PrivateChannelPrefix: centrifuge.DefaultPrivateChannelPrefix,
+		Timeout:              centrifuge.DefaultTimeout,
+		SubBufferSize:        1,
+		SubOverflowPolicy:    centrifuge.OverflowDropNewest,
+		ReconnectStrategy:    &centrifuge.PeriodicReconnect{ReconnectInterval: 10 * time.Millisecond},
+		Metrics:              metrics,
+	}
+	reconnected := make(chan struct{}, 1)
+	c := centrifuge.NewCentrifuge(s.URL, "project", &centrifuge.Credentials{
+		User:      "1",
+		Timestamp: centrifuge.Timestamp(),
+		Token:     "token",
+	}, &centrifuge.EventHandler{
+		OnReconnected: func(centrifuge.Centrifuge) {
+			reconnected <- struct{}{}
+		},
+	}, config)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	defer c.Close()
+
+	received := make(chan struct{}, 1)
+	sub, err := c.Subscribe("channel", &centrifuge.SubEventHandler{
+		OnMessage: func(sub *centrifuge.Sub, msg libcentrifugo.Message) error {
+			received <- struct{}{}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	s.SetError("publish", centrifugetest.ErrPermissionDenied)
+	if sub.Publish([]byte(`{}`)) == nil {
+		t.Fatal("Publish must fail")
+	}
+	// Second message does not fit into unread channel.
+	sub.Messages()
+	for i := 0; i < 2; i++ {
+		s.Publish("channel", []byte(`{}`))
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+	s.DropConnections()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client not reconnected")
+	}
+
+	expected := `
+# HELP centrifuge_client_commands_total Number of commands sent by method and outcome.
+# TYPE centrifuge_client_commands_total counter
+centrifuge_client_commands_total{method="connect",outcome="ok"} 2
+centrifuge_client_commands_total{method="publish",outcome="error"} 1
+centrifuge_client_commands_total{method="subscribe",outcome="ok"} 2
+# HELP centrifuge_client_dropped_total Number of messages, join and leave events dropped by slow subscriptions.
+# TYPE centrifuge_client_dropped_total counter
+centrifuge_client_dropped_total{channel="channel"} 1
+# HELP centrifuge_client_messages_total Number of messages delivered to subscriptions.
+# TYPE centrifuge_client_messages_total counter
+centrifuge_client_messages_total{channel="channel"} 2
+# HELP centrifuge_client_reconnects_total Number of reconnect attempts by outcome.
+# TYPE centrifuge_client_reconnects_total counter
+centrifuge_client_reconnects_total{outcome="ok"} 1
+`
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"centrifuge_client_commands_total", "centrifuge_client_dropped_total", "centrifuge_client_messages_total", "centrifuge_client_reconnects_total")
+	if err != nil {
+		t.Error(err)
+	}
+	n, err := testutil.GatherAndCount(registry, "centrifuge_client_command_duration_seconds", "centrifuge_client_queue_depth")
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	if n < 4 {
+		t.Errorf("Expected latency and queue metrics, got %d", n)
+	}
+}
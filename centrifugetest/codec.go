@@ -0,0 +1,109 @@
+package centrifugetest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var errMalformedFrame = errors.New("malformed frame")
+
+// codec is server side of client codecs. Command params and reply bodies
+// are encoded separately and embedded as raw values.
+type codec interface {
+	binary() bool
+	marshal(v interface{}) ([]byte, error)
+	unmarshal(data []byte, v interface{}) error
+	// frame joins encoded replies, array makes JSON use array frame even
+	// for one reply.
+	frame(msgs [][]byte, array bool) []byte
+	// split splits frame into encoded commands and reports whether they
+	// came as JSON array.
+	split(frame []byte) ([][]byte, bool, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) binary() bool {
+	return false
+}
+
+func (jsonCodec) marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) frame(msgs [][]byte, array bool) []byte {
+	if len(msgs) == 1 && !array {
+		return msgs[0]
+	}
+	return append(append([]byte{'['}, bytes.Join(msgs, []byte{','})...), ']')
+}
+
+func (jsonCodec) split(frame []byte) ([][]byte, bool, error) {
+	trimmed := bytes.TrimSpace(frame)
+	if !bytes.HasPrefix(trimmed, []byte("[")) {
+		return [][]byte{frame}, false, nil
+	}
+	var raws []json.RawMessage
+	err := json.Unmarshal(frame, &raws)
+	msgs := make([][]byte, len(raws))
+	for i, raw := range raws {
+		msgs[i] = raw
+	}
+	return msgs, true, err
+}
+
+// msgpackCodec is used for clients sending binary frames. Every message in
+// frame is prefixed with its length as unsigned varint.
+type msgpackCodec struct{}
+
+func (msgpackCodec) binary() bool {
+	return true
+}
+
+func (msgpackCodec) marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func (msgpackCodec) frame(msgs [][]byte, array bool) []byte {
+	var frame []byte
+	for _, msg := range msgs {
+		frame = binary.AppendUvarint(frame, uint64(len(msg)))
+		frame = append(frame, msg...)
+	}
+	return frame
+}
+
+func (msgpackCodec) split(frame []byte) ([][]byte, bool, error) {
+	var msgs [][]byte
+	for len(frame) > 0 {
+		size, n := binary.Uvarint(frame)
+		if n <= 0 || uint64(len(frame)-n) < size {
+			return nil, false, errMalformedFrame
+		}
+		frame = frame[n:]
+		msgs = append(msgs, frame[:size])
+		frame = frame[size:]
+	}
+	return msgs, len(msgs) > 1, nil
+}
@@ -0,0 +1,755 @@
+// Package centrifugetest provides in-process Centrifugo server speaking the
+// same JSON websocket protocol as real server. It is meant to test code
+// built on top of centrifuge client end to end without running Centrifugo.
+package centrifugetest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shilkin/centrifugo/libcentrifugo"
+)
+
+// Errors returned to clients in response error field.
+const (
+	ErrPermissionDenied = "permission denied"
+	ErrMethodNotFound   = "method not found"
+	ErrInvalidMessage   = "invalid message"
+	ErrUnauthorized     = "unauthorized"
+)
+
+const (
+	// DefaultHistorySize is a number of messages kept per channel.
+	DefaultHistorySize = 10
+	// DefaultPrivateChannelPrefix must match client Config.
+	DefaultPrivateChannelPrefix = "$"
+)
+
+type command struct {
+	UID    string          `json:"uid"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type response struct {
+	UID    string      `json:"uid,omitempty"`
+	Error  string      `json:"error"`
+	Method string      `json:"method"`
+	Body   interface{} `json:"body"`
+}
+
+// encodedResponse is response as sent to client, body is encoded
+// separately and embedded as raw value.
+type encodedResponse struct {
+	UID    string          `json:"uid,omitempty"`
+	Error  string          `json:"error"`
+	Method string          `json:"method"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// Server is a fake Centrifugo server listening on local address.
+type Server struct {
+	// URL is websocket address to pass into centrifuge.NewCentrifuge.
+	URL string
+	// SockJSURL is base address of SockJS endpoint.
+	SockJSURL string
+
+	// HistorySize is a number of messages kept for history and recovery.
+	HistorySize int
+	// JoinLeave enables join and leave messages for all channels.
+	JoinLeave bool
+	// TTL in seconds returned in connect and refresh replies, 0 means
+	// connection never expires.
+	TTL int64
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mutex    sync.Mutex
+	clients  map[libcentrifugo.ConnID]*client
+	history  map[libcentrifugo.Channel][]libcentrifugo.Message
+	delays   map[string]time.Duration
+	errors   map[string]string
+	expired  bool
+	silent   bool
+	noWS     bool
+	nextID   int
+	received []Command
+	headers  []http.Header
+	sessions map[string]*sockjsSession
+}
+
+// Command is a client command as seen by server. Params are encoded with
+// client codec, JSON unless client sends binary frames.
+type Command struct {
+	Client libcentrifugo.ConnID
+	Method string
+	Params json.RawMessage
+}
+
+// NewServer starts new Server. It must be closed with Close.
+func NewServer() *Server {
+	s := &Server{
+		HistorySize: DefaultHistorySize,
+		clients:     make(map[libcentrifugo.ConnID]*client),
+		history:     make(map[libcentrifugo.Channel][]libcentrifugo.Message),
+		delays:      make(map[string]time.Duration),
+		errors:      make(map[string]string),
+		sessions:    make(map[string]*sockjsSession),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connection/websocket", s.serveWS)
+	mux.HandleFunc("/connection/", s.serveSockJS)
+	s.server = httptest.NewServer(mux)
+	s.URL = "ws" + strings.TrimPrefix(s.server.URL, "http") + "/connection/websocket"
+	s.SockJSURL = s.server.URL + "/connection"
+	return s
+}
+
+// Close disconnects all clients and shuts server down.
+func (s *Server) Close() {
+	s.DropConnections()
+	s.server.Close()
+}
+
+// SetDelay makes server wait before replying on commands with method.
+// Zero duration removes delay.
+func (s *Server) SetDelay(method string, d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if d == 0 {
+		delete(s.delays, method)
+		return
+	}
+	s.delays[method] = d
+}
+
+// SetError makes server reply with err on commands with method. Empty err
+// removes injected error.
+func (s *Server) SetError(method string, err string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == "" {
+		delete(s.errors, method)
+		return
+	}
+	s.errors[method] = err
+}
+
+// SetExpired makes server consider all client credentials expired, so
+// connect and refresh replies have expired flag set.
+func (s *Server) SetExpired(expired bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expired = expired
+}
+
+// SetUnresponsive makes server stop answering commands and websocket pings
+// while keeping connections open, as if network became half-open.
+func (s *Server) SetUnresponsive(unresponsive bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.silent = unresponsive
+}
+
+// SetWebsocketDisabled makes server reject websocket handshakes as proxies
+// stripping upgrade headers do. SockJS endpoint keeps working.
+func (s *Server) SetWebsocketDisabled(disabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.noWS = disabled
+}
+
+func (s *Server) unresponsive() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.silent
+}
+
+// Disconnect sends disconnect message to all clients and closes their
+// connections.
+func (s *Server) Disconnect(reason string, reconnect bool) {
+	for _, cl := range s.clientList() {
+		cl.send(response{
+			Method: "disconnect",
+			Body:   libcentrifugo.DisconnectBody{Reason: reason, Reconnect: reconnect},
+		})
+		cl.close()
+	}
+}
+
+// DropConnections closes all client connections without any message, as
+// if network went down.
+func (s *Server) DropConnections() {
+	for _, cl := range s.clientList() {
+		cl.close()
+	}
+}
+
+// Unsubscribe unsubscribes all clients from channel as if it was done by
+// server API.
+func (s *Server) Unsubscribe(channel string) {
+	ch := libcentrifugo.Channel(channel)
+	for _, cl := range s.subscribers(ch) {
+		cl.handleUnsubscribe(libcentrifugo.UnsubscribeClientCommand{Channel: ch})
+		cl.send(response{
+			Method: "unsubscribe",
+			Body:   libcentrifugo.UnsubscribeBody{Channel: ch, Status: true},
+		})
+	}
+}
+
+// Publish sends data into channel as if it was published by server API.
+func (s *Server) Publish(channel string, data []byte) {
+	s.publish(libcentrifugo.Channel(channel), json.RawMessage(data), nil, "")
+}
+
+// NumClients returns number of connected clients.
+func (s *Server) NumClients() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.clients)
+}
+
+// Commands returns all commands received by server so far.
+func (s *Server) Commands() []Command {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	commands := make([]Command, len(s.received))
+	copy(commands, s.received)
+	return commands
+}
+
+// Handshakes returns headers of every websocket handshake request received
+// by server so far.
+func (s *Server) Handshakes() []http.Header {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	headers := make([]http.Header, len(s.headers))
+	copy(headers, s.headers)
+	return headers
+}
+
+func (s *Server) clientList() []*client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, cl := range s.clients {
+		clients = append(clients, cl)
+	}
+	return clients
+}
+
+func (s *Server) subscribers(channel libcentrifugo.Channel) []*client {
+	var clients []*client
+	for _, cl := range s.clientList() {
+		if cl.subscribed(channel) {
+			clients = append(clients, cl)
+		}
+	}
+	return clients
+}
+
+func (s *Server) serveWS(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.headers = append(s.headers, r.Header.Clone())
+	disabled := s.noWS
+	s.mutex.Unlock()
+
+	if disabled {
+		http.Error(w, "websocket disabled", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	t := &wsTransport{conn: conn}
+	cl := newClient(s, t)
+	conn.SetPingHandler(func(data string) error {
+		if s.unresponsive() {
+			return nil
+		}
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	defer cl.close()
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			cl.setCodec(msgpackCodec{})
+		}
+		if !cl.handleData(data) {
+			return
+		}
+	}
+}
+
+// transport delivers encoded replies to client connection.
+type transport interface {
+	write(data []byte, binary bool)
+	close()
+}
+
+type wsTransport struct {
+	mutex sync.Mutex
+	conn  *websocket.Conn
+}
+
+func (t *wsTransport) write(data []byte, binary bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	messageType := websocket.TextMessage
+	if binary {
+		messageType = websocket.BinaryMessage
+	}
+	t.conn.WriteMessage(messageType, data)
+}
+
+func (t *wsTransport) close() {
+	t.conn.Close()
+}
+
+func (s *Server) newClientID() libcentrifugo.ConnID {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextID++
+	return libcentrifugo.ConnID("client-" + strconv.Itoa(s.nextID))
+}
+
+func (s *Server) newMessageID() libcentrifugo.MessageID {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextID++
+	return libcentrifugo.MessageID("message-" + strconv.Itoa(s.nextID))
+}
+
+func (s *Server) publish(channel libcentrifugo.Channel, data json.RawMessage, info *libcentrifugo.ClientInfo, client libcentrifugo.ConnID) {
+	raw := data
+	m := libcentrifugo.Message{
+		UID:       s.newMessageID(),
+		Timestamp: strconv.FormatInt(time.Now().Unix(), 10),
+		Info:      info,
+		Channel:   channel,
+		Data:      &raw,
+		Client:    client,
+	}
+
+	s.mutex.Lock()
+	if s.HistorySize > 0 {
+		// History is kept newest first as Centrifugo does.
+		history := append([]libcentrifugo.Message{m}, s.history[channel]...)
+		if len(history) > s.HistorySize {
+			history = history[:s.HistorySize]
+		}
+		s.history[channel] = history
+	}
+	s.mutex.Unlock()
+
+	for _, cl := range s.subscribers(channel) {
+		cl.send(response{Method: "message", Body: m})
+	}
+}
+
+// recover returns messages published after last, newest first, and whether
+// last was still present in history.
+func (s *Server) recover(channel libcentrifugo.Channel, last libcentrifugo.MessageID) ([]libcentrifugo.Message, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	history := s.history[channel]
+	for i, m := range history {
+		if m.UID == last {
+			messages := make([]libcentrifugo.Message, i)
+			copy(messages, history[:i])
+			return messages, true
+		}
+	}
+	messages := make([]libcentrifugo.Message, len(history))
+	copy(messages, history)
+	return messages, false
+}
+
+// last returns ID of newest message in channel history, empty when there
+// is none.
+func (s *Server) last(channel libcentrifugo.Channel) libcentrifugo.MessageID {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	history := s.history[channel]
+	if len(history) == 0 {
+		return ""
+	}
+	return history[0].UID
+}
+
+func (s *Server) joinLeave(method string, channel libcentrifugo.Channel, info libcentrifugo.ClientInfo) {
+	s.mutex.Lock()
+	enabled := s.JoinLeave
+	s.mutex.Unlock()
+	if !enabled {
+		return
+	}
+	body := libcentrifugo.JoinLeaveBody{Channel: channel, Data: info}
+	for _, cl := range s.subscribers(channel) {
+		cl.send(response{Method: method, Body: body})
+	}
+}
+
+type client struct {
+	server    *Server
+	transport transport
+	closeOnce sync.Once
+
+	mutex  sync.Mutex
+	codec  codec
+	id     libcentrifugo.ConnID
+	user   libcentrifugo.UserID
+	authed bool
+	subs   map[libcentrifugo.Channel]struct{}
+}
+
+func newClient(s *Server, t transport) *client {
+	return &client{
+		server:    s,
+		transport: t,
+		codec:     jsonCodec{},
+		subs:      make(map[libcentrifugo.Channel]struct{}),
+	}
+}
+
+// handleData handles one incoming frame. It returns false when connection
+// must be closed.
+func (c *client) handleData(data []byte) bool {
+	if c.server.unresponsive() {
+		return true
+	}
+	codec := c.getCodec()
+	msgs, array, err := codec.split(data)
+	var commands []command
+	for _, msg := range msgs {
+		if err != nil {
+			break
+		}
+		var cmd command
+		err = codec.unmarshal(msg, &cmd)
+		commands = append(commands, cmd)
+	}
+	if err != nil {
+		c.send(response{Error: ErrInvalidMessage})
+		return false
+	}
+	var replies []response
+	for _, cmd := range commands {
+		replies = append(replies, c.handle(cmd))
+	}
+	if array {
+		c.sendFrame(replies, true)
+		return true
+	}
+	for _, reply := range replies {
+		c.send(reply)
+	}
+	return true
+}
+
+func (c *client) setCodec(codec codec) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.codec = codec
+}
+
+func (c *client) getCodec() codec {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.codec
+}
+
+func (c *client) send(resp response) {
+	c.sendFrame([]response{resp}, false)
+}
+
+// sendFrame sends replies in one frame, JSON array is used when array is
+// set even for one reply.
+func (c *client) sendFrame(replies []response, array bool) {
+	codec := c.getCodec()
+	msgs := make([][]byte, 0, len(replies))
+	for _, resp := range replies {
+		body, err := codec.marshal(resp.Body)
+		if err != nil {
+			return
+		}
+		msg, err := codec.marshal(encodedResponse{
+			UID:    resp.UID,
+			Error:  resp.Error,
+			Method: resp.Method,
+			Body:   body,
+		})
+		if err != nil {
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	c.transport.write(codec.frame(msgs, array), codec.binary())
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		c.transport.close()
+		c.mutex.Lock()
+		id := c.id
+		subs := c.subs
+		c.subs = make(map[libcentrifugo.Channel]struct{})
+		c.mutex.Unlock()
+		if id == "" {
+			return
+		}
+		c.server.mutex.Lock()
+		delete(c.server.clients, id)
+		c.server.mutex.Unlock()
+		for channel := range subs {
+			c.server.joinLeave("leave", channel, c.info())
+		}
+	})
+}
+
+func (c *client) subscribed(channel libcentrifugo.Channel) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.subs[channel]
+	return ok
+}
+
+func (c *client) info() libcentrifugo.ClientInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return libcentrifugo.ClientInfo{User: c.user, Client: c.id}
+}
+
+func (c *client) handle(cmd command) response {
+	s := c.server
+	s.mutex.Lock()
+	s.received = append(s.received, Command{Client: c.id, Method: cmd.Method, Params: cmd.Params})
+	delay := s.delays[cmd.Method]
+	injected := s.errors[cmd.Method]
+	s.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	resp := response{UID: cmd.UID, Method: cmd.Method}
+	if injected != "" {
+		resp.Error = injected
+		return resp
+	}
+
+	c.mutex.Lock()
+	authed := c.authed
+	c.mutex.Unlock()
+	if !authed && cmd.Method != "connect" {
+		resp.Error = ErrUnauthorized
+		return resp
+	}
+
+	body, err := c.dispatch(cmd)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	resp.Body = body
+	return resp
+}
+
+func (c *client) dispatch(cmd command) (interface{}, error) {
+	switch cmd.Method {
+	case "connect":
+		var params libcentrifugo.ConnectClientCommand
+		if err := c.getCodec().unmarshal(cmd.Params, &params); err != nil {
+			return nil, errors.New(ErrInvalidMessage)
+		}
+		return c.handleConnect(params), nil
+	case "refresh":
+		var params libcentrifugo.RefreshClientCommand
+		if err := c.getCodec().unmarshal(cmd.Params, &params); err != nil {
+			return nil, errors.New(ErrInvalidMessage)
+		}
+		return c.handleRefresh(params), nil
+	case "subscribe":
+		var params libcentrifugo.SubscribeClientCommand
+		if err := c.getCodec().unmarshal(cmd.Params, &params); err != nil {
+			return nil, errors.New(ErrInvalidMessage)
+		}
+		return c.handleSubscribe(params)
+	case "unsubscribe":
+		var params libcentrifugo.UnsubscribeClientCommand
+		if err := c.getCodec().unmarshal(cmd.Params, &params); err != nil {
+			return nil, errors.New(ErrInvalidMessage)
+		}
+		return c.handleUnsubscribe(params), nil
+	case "publish":
+		var params libcentrifugo.PublishClientCommand
+		if err := c.getCodec().unmarshal(cmd.Params, &params); err != nil {
+			return nil, errors.New(ErrInvalidMessage)
+		}
+		return c.handlePublish(params)
+	case "history":
+		var params libcentrifugo.HistoryClientCommand
+		if err := c.getCodec().unmarshal(cmd.Params, &params); err != nil {
+			return nil, errors.New(ErrInvalidMessage)
+		}
+		return c.handleHistory(params)
+	case "presence":
+		var params libcentrifugo.PresenceClientCommand
+		if err := c.getCodec().unmarshal(cmd.Params, &params); err != nil {
+			return nil, errors.New(ErrInvalidMessage)
+		}
+		return c.handlePresence(params)
+	case "ping":
+		return libcentrifugo.PingBody{}, nil
+	default:
+		return nil, errors.New(ErrMethodNotFound)
+	}
+}
+
+func (c *client) connectBody() libcentrifugo.ConnectBody {
+	s := c.server
+	s.mutex.Lock()
+	expired := s.expired
+	ttl := s.TTL
+	s.mutex.Unlock()
+
+	c.mutex.Lock()
+	id := c.id
+	c.mutex.Unlock()
+
+	body := libcentrifugo.ConnectBody{
+		Version: "centrifugetest",
+		Expires: ttl > 0,
+		Expired: expired,
+	}
+	if !expired {
+		body.Client = &id
+	}
+	if ttl > 0 {
+		body.TTL = &ttl
+	}
+	return body
+}
+
+func (c *client) handleConnect(params libcentrifugo.ConnectClientCommand) libcentrifugo.ConnectBody {
+	s := c.server
+	c.mutex.Lock()
+	authed := c.authed
+	c.mutex.Unlock()
+
+	s.mutex.Lock()
+	expired := s.expired
+	s.mutex.Unlock()
+
+	if !authed && !expired {
+		id := s.newClientID()
+		c.mutex.Lock()
+		c.id = id
+		c.user = params.User
+		c.authed = true
+		c.mutex.Unlock()
+
+		s.mutex.Lock()
+		s.clients[id] = c
+		s.mutex.Unlock()
+	}
+	return c.connectBody()
+}
+
+func (c *client) handleRefresh(params libcentrifugo.RefreshClientCommand) libcentrifugo.ConnectBody {
+	c.mutex.Lock()
+	c.user = params.User
+	c.mutex.Unlock()
+	return c.connectBody()
+}
+
+func (c *client) handleSubscribe(params libcentrifugo.SubscribeClientCommand) (libcentrifugo.SubscribeBody, error) {
+	channel := params.Channel
+	if strings.HasPrefix(string(channel), DefaultPrivateChannelPrefix) {
+		c.mutex.Lock()
+		id := c.id
+		c.mutex.Unlock()
+		if params.Sign == "" || params.Client != id {
+			return libcentrifugo.SubscribeBody{}, errors.New(ErrPermissionDenied)
+		}
+	}
+
+	body := libcentrifugo.SubscribeBody{Channel: channel, Status: true}
+	if params.Recover {
+		body.Messages, body.Recovered = c.server.recover(channel, params.Last)
+	}
+	body.Last = c.server.last(channel)
+
+	c.mutex.Lock()
+	c.subs[channel] = struct{}{}
+	c.mutex.Unlock()
+
+	c.server.joinLeave("join", channel, c.info())
+	return body, nil
+}
+
+func (c *client) handleUnsubscribe(params libcentrifugo.UnsubscribeClientCommand) libcentrifugo.UnsubscribeBody {
+	channel := params.Channel
+	c.mutex.Lock()
+	_, ok := c.subs[channel]
+	delete(c.subs, channel)
+	c.mutex.Unlock()
+
+	if ok {
+		c.server.joinLeave("leave", channel, c.info())
+	}
+	return libcentrifugo.UnsubscribeBody{Channel: channel, Status: true}
+}
+
+func (c *client) handlePublish(params libcentrifugo.PublishClientCommand) (libcentrifugo.PublishBody, error) {
+	if !c.subscribed(params.Channel) {
+		return libcentrifugo.PublishBody{}, errors.New(ErrPermissionDenied)
+	}
+	info := c.info()
+	c.server.publish(params.Channel, params.Data, &info, info.Client)
+	return libcentrifugo.PublishBody{Channel: params.Channel, Status: true}, nil
+}
+
+func (c *client) handleHistory(params libcentrifugo.HistoryClientCommand) (libcentrifugo.HistoryBody, error) {
+	if !c.subscribed(params.Channel) {
+		return libcentrifugo.HistoryBody{}, errors.New(ErrPermissionDenied)
+	}
+	s := c.server
+	s.mutex.Lock()
+	data := make([]libcentrifugo.Message, len(s.history[params.Channel]))
+	copy(data, s.history[params.Channel])
+	s.mutex.Unlock()
+	return libcentrifugo.HistoryBody{Channel: params.Channel, Data: data}, nil
+}
+
+func (c *client) handlePresence(params libcentrifugo.PresenceClientCommand) (libcentrifugo.PresenceBody, error) {
+	if !c.subscribed(params.Channel) {
+		return libcentrifugo.PresenceBody{}, errors.New(ErrPermissionDenied)
+	}
+	data := make(map[libcentrifugo.ConnID]libcentrifugo.ClientInfo)
+	for _, cl := range c.server.subscribers(params.Channel) {
+		info := cl.info()
+		data[info.Client] = info
+	}
+	return libcentrifugo.PresenceBody{Channel: params.Channel, Data: data}, nil
+}
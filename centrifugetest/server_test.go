@@ -0,0 +1,148 @@
+package centrifugetest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shilkin/centrifuge-go"
+	"github.com/shilkin/centrifuge-go/centrifugetest"
+	"github.com/shilkin/centrifugo/libcentrifugo"
+)
+
+func testCredentials() *centrifuge.Credentials {
+	return &centrifuge.Credentials{
+		User:      "1",
+		Timestamp: centrifuge.Timestamp(),
+		Token:     "token",
+	}
+}
+
+func connect(t *testing.T, s *centrifugetest.Server, events *centrifuge.EventHandler) centrifuge.Centrifuge {
+	c := centrifuge.NewCentrifuge(s.URL, "project", testCredentials(), events, centrifuge.DefaultConfig)
+	err := c.Connect()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	return c
+}
+
+func TestPublishAndReceive(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	c := connect(t, s, nil)
+	defer c.Close()
+
+	received := make(chan libcentrifugo.Message, 1)
+	sub, err := c.Subscribe("channel", &centrifuge.SubEventHandler{
+		OnMessage: func(sub *centrifuge.Sub, msg libcentrifugo.Message) error {
+			received <- msg
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	err = sub.Publish([]byte(`{"input":"1"}`))
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+
+	select {
+	case msg := <-received:
+		if string(*msg.Data) != `{"input":"1"}` {
+			t.Errorf("Unexpected message data %s", *msg.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No incoming message")
+	}
+
+	history, err := sub.History()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	if len(history) != 1 {
+		t.Errorf("Unexpected history length %d", len(history))
+	}
+
+	presence, err := sub.Presence()
+	if err != nil {
+		t.Fatalf("Should pass but error is '%s'", err)
+	}
+	if _, ok := presence[libcentrifugo.ConnID(c.ClientID())]; !ok {
+		t.Errorf("Client not found in presence %v", presence)
+	}
+}
+
+func TestInjectedError(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+	s.SetError("subscribe", centrifugetest.ErrPermissionDenied)
+
+	c := connect(t, s, nil)
+	defer c.Close()
+
+	_, err := c.Subscribe("channel", nil)
+	if err == nil || err.Error() != centrifugetest.ErrPermissionDenied {
+		t.Errorf("Unexpected error '%v'", err)
+	}
+}
+
+func TestInjectedDelay(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	c := connect(t, s, nil)
+	defer c.Close()
+
+	s.SetDelay("subscribe", 2*centrifuge.DefaultTimeout)
+	_, err := c.Subscribe("channel", nil)
+	if err != centrifuge.ErrTimeout {
+		t.Errorf("Unexpected error '%v'", err)
+	}
+}
+
+func TestExpiredCredentials(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+	s.SetExpired(true)
+
+	refreshed := false
+	events := &centrifuge.EventHandler{
+		OnRefresh: func(centrifuge.Centrifuge) (*centrifuge.Credentials, error) {
+			refreshed = true
+			s.SetExpired(false)
+			return testCredentials(), nil
+		},
+	}
+	c := connect(t, s, events)
+	defer c.Close()
+
+	if !refreshed {
+		t.Error("Credentials were not refreshed")
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	s := centrifugetest.NewServer()
+	defer s.Close()
+
+	disconnected := make(chan struct{})
+	events := &centrifuge.EventHandler{
+		OnDisconnect: func(centrifuge.Centrifuge) error {
+			close(disconnected)
+			return nil
+		},
+	}
+	c := connect(t, s, events)
+	defer c.Close()
+
+	s.DropConnections()
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect not detected")
+	}
+}
@@ -0,0 +1,190 @@
+package centrifugetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SockJS frames, see https://github.com/sockjs/sockjs-protocol.
+const (
+	sockjsOpenFrame      = "o\n"
+	sockjsHeartbeatFrame = "h\n"
+	sockjsCloseFrame     = "c[3000,\"Go away!\"]\n"
+)
+
+// sockjsHeartbeatDelay is how long polling and streaming requests wait for
+// messages before heartbeat frame is sent.
+const sockjsHeartbeatDelay = time.Second
+
+// sockjsSession is a transport for SockJS xhr-streaming and xhr-polling
+// clients. Replies are queued until client comes for them.
+type sockjsSession struct {
+	client    *client
+	mutex     sync.Mutex
+	queue     []string
+	notify    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// write queues data, SockJS sessions only carry JSON frames.
+func (t *sockjsSession) write(data []byte, binary bool) {
+	t.mutex.Lock()
+	t.queue = append(t.queue, string(data))
+	t.mutex.Unlock()
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// close closes session. Closed session is kept so later requests receive
+// close frame.
+func (t *sockjsSession) close() {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+}
+
+func (t *sockjsSession) requeue(messages []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.queue = append(messages, t.queue...)
+}
+
+// take waits for queued messages. It returns closed true when session is
+// closed, messages queued before close are still returned.
+func (t *sockjsSession) take(done <-chan struct{}) ([]string, bool) {
+	timer := time.NewTimer(sockjsHeartbeatDelay)
+	defer timer.Stop()
+	for {
+		t.mutex.Lock()
+		messages := t.queue
+		t.queue = nil
+		t.mutex.Unlock()
+		if len(messages) > 0 {
+			return messages, false
+		}
+		select {
+		case <-t.notify:
+		case <-t.closed:
+			t.mutex.Lock()
+			messages = t.queue
+			t.queue = nil
+			t.mutex.Unlock()
+			return messages, true
+		case <-timer.C:
+			return nil, false
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+func (s *Server) session(id string, create bool) (*sockjsSession, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		return sess, false
+	}
+	if !create {
+		return nil, false
+	}
+	sess := &sockjsSession{
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	sess.client = newClient(s, sess)
+	s.sessions[id] = sess
+	return sess, true
+}
+
+func writeFrames(w http.ResponseWriter, messages []string, closed bool) {
+	if len(messages) > 0 {
+		data, _ := json.Marshal(messages)
+		w.Write([]byte("a" + string(data) + "\n"))
+	}
+	if closed {
+		w.Write([]byte(sockjsCloseFrame))
+	}
+	if len(messages) == 0 && !closed {
+		w.Write([]byte(sockjsHeartbeatFrame))
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveSockJS handles /connection/{server}/{session}/{transport} requests.
+func (s *Server) serveSockJS(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/connection/"), "/")
+	if len(parts) != 3 || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	id, transport := parts[1], parts[2]
+
+	switch transport {
+	case "xhr":
+		sess, created := s.session(id, true)
+		w.Header().Set("Content-Type", "application/javascript; charset=UTF-8")
+		if created {
+			w.Write([]byte(sockjsOpenFrame))
+			return
+		}
+		messages, closed := sess.take(r.Context().Done())
+		writeFrames(w, messages, closed)
+	case "xhr_streaming":
+		sess, created := s.session(id, true)
+		w.Header().Set("Content-Type", "application/javascript; charset=UTF-8")
+		// Prelude makes browsers start handling streamed response.
+		w.Write([]byte(strings.Repeat("h", 2048) + "\n"))
+		if created {
+			w.Write([]byte(sockjsOpenFrame))
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		for {
+			messages, closed := sess.take(r.Context().Done())
+			select {
+			case <-r.Context().Done():
+				// Client went away, keep messages for next request.
+				sess.requeue(messages)
+				return
+			default:
+			}
+			writeFrames(w, messages, closed)
+			if closed {
+				return
+			}
+		}
+	case "xhr_send":
+		sess, _ := s.session(id, false)
+		if sess == nil {
+			http.NotFound(w, r)
+			return
+		}
+		var messages []string
+		err := json.NewDecoder(r.Body).Decode(&messages)
+		if err != nil {
+			http.Error(w, "Broken JSON encoding.", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		for _, m := range messages {
+			if !sess.client.handleData([]byte(m)) {
+				sess.client.close()
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
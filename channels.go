@@ -0,0 +1,313 @@
+package centrifuge
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/shilkin/centrifugo/libcentrifugo"
+)
+
+// DefaultSubBufferSize is capacity of Sub.Messages and Sub.Events channels.
+const DefaultSubBufferSize = 64
+
+var ErrSubBufferOverflow = errors.New("subscription buffer overflow")
+
+// OverflowPolicy decides what happens when Sub.Messages or Sub.Events
+// channel is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until consumer reads from channel. Other events
+	// of subscription wait meanwhile in dispatch queue.
+	OverflowBlock = OverflowPolicy(iota)
+	// OverflowDropOldest removes oldest buffered value to make room.
+	OverflowDropOldest
+	// OverflowDropNewest discards value which does not fit.
+	OverflowDropNewest
+	// OverflowDisconnect drops connection, so client reconnects when
+	// Config.ReconnectStrategy is set and recovers messages consumer missed.
+	OverflowDisconnect
+)
+
+// SubEventType is a kind of SubEvent.
+type SubEventType int
+
+const (
+	SubEventMessage = SubEventType(iota)
+	SubEventJoin
+	SubEventLeave
+	SubEventUnsubscribe
+	// Following types only tell which handler failed in HandlerError,
+	// they are not sent to Sub.Events.
+	SubEventSubscribeSuccess
+	SubEventSubscribeError
+	SubEventRecovered
+)
+
+// String returns lowercase event type name.
+func (t SubEventType) String() string {
+	switch t {
+	case SubEventMessage:
+		return "message"
+	case SubEventJoin:
+		return "join"
+	case SubEventLeave:
+		return "leave"
+	case SubEventUnsubscribe:
+		return "unsubscribe"
+	case SubEventSubscribeSuccess:
+		return "subscribe success"
+	case SubEventSubscribeError:
+		return "subscribe error"
+	case SubEventRecovered:
+		return "recovered"
+	default:
+		return "unknown"
+	}
+}
+
+// SubEvent is sent to Sub.Events channel. Message is set for
+// SubEventMessage, Info for SubEventJoin and SubEventLeave, Reason for
+// SubEventUnsubscribe.
+type SubEvent struct {
+	Type    SubEventType
+	Message libcentrifugo.Message
+	Info    libcentrifugo.ClientInfo
+	Reason  UnsubscribeReason
+}
+
+// subChannels holds channels returned by Sub.Messages and Sub.Events. They
+// are created on first call, so subscriptions consumed with callbacks only
+// never block on them.
+type subChannels struct {
+	mutex    sync.Mutex
+	messages chan libcentrifugo.Message
+	events   chan SubEvent
+	closed   bool
+	done     chan struct{}
+	sending  sync.WaitGroup
+	// overflowed is set when OverflowDisconnect dropped message, all
+	// messages are dropped then until resubscribe recovers them.
+	overflowed bool
+}
+
+// Messages returns channel receiving subscription messages. It is closed
+// when subscription ends, so it can be consumed with for range loop. Call
+// it right after Subscribe, messages received before first call are only
+// passed to SubEventHandler. Buffer size and behaviour when buffer is full
+// are set with Config.SubBufferSize and Config.SubOverflowPolicy.
+func (s *Sub) Messages() <-chan libcentrifugo.Message {
+	s.channels.mutex.Lock()
+	defer s.channels.mutex.Unlock()
+	s.channels.init()
+	if s.channels.messages == nil {
+		s.channels.messages = make(chan libcentrifugo.Message, s.bufferSize())
+		if s.channels.closed {
+			close(s.channels.messages)
+		}
+	}
+	return s.channels.messages
+}
+
+// Events returns channel receiving messages, join, leave and unsubscribe
+// events. It works the same way as Messages. Unsubscribe event is only
+// sent when there is room in buffer, closed channel means subscription
+// ended anyway.
+func (s *Sub) Events() <-chan SubEvent {
+	s.channels.mutex.Lock()
+	defer s.channels.mutex.Unlock()
+	s.channels.init()
+	if s.channels.events == nil {
+		s.channels.events = make(chan SubEvent, s.bufferSize())
+		if s.channels.closed {
+			close(s.channels.events)
+		}
+	}
+	return s.channels.events
+}
+
+// Lock must be held outside
+func (c *subChannels) init() {
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+}
+
+func (s *Sub) bufferSize() int {
+	if s.centrifuge == nil || s.centrifuge.config.SubBufferSize <= 0 {
+		return DefaultSubBufferSize
+	}
+	return s.centrifuge.config.SubBufferSize
+}
+
+func (s *Sub) overflowPolicy() OverflowPolicy {
+	if s.centrifuge == nil {
+		return OverflowBlock
+	}
+	return s.centrifuge.config.SubOverflowPolicy
+}
+
+// subTargets tells which channels existed when event was received. Event
+// is dispatched later and must not reach channels created meanwhile.
+type subTargets struct {
+	messages bool
+	events   bool
+}
+
+func (s *Sub) targets() subTargets {
+	s.channels.mutex.Lock()
+	defer s.channels.mutex.Unlock()
+	return subTargets{messages: s.channels.messages != nil, events: s.channels.events != nil}
+}
+
+// beginSend returns channels of targets to send into, ok is false when
+// there are none. endSend must be called after send when ok is true.
+func (s *Sub) beginSend(targets subTargets) (messages chan libcentrifugo.Message, events chan SubEvent, ok bool) {
+	s.channels.mutex.Lock()
+	defer s.channels.mutex.Unlock()
+	if targets.messages {
+		messages = s.channels.messages
+	}
+	if targets.events {
+		events = s.channels.events
+	}
+	if s.channels.closed || (messages == nil && events == nil) {
+		return nil, nil, false
+	}
+	s.channels.sending.Add(1)
+	return messages, events, true
+}
+
+func (s *Sub) endSend() {
+	s.channels.sending.Done()
+}
+
+// sendMessage passes m into channels. It returns false when m was dropped
+// and must not be considered delivered.
+func (s *Sub) sendMessage(m libcentrifugo.Message, targets subTargets) bool {
+	messages, events, ok := s.beginSend(targets)
+	if !ok {
+		return true
+	}
+	defer s.endSend()
+
+	s.channels.mutex.Lock()
+	overflowed := s.channels.overflowed
+	s.channels.mutex.Unlock()
+	if overflowed {
+		s.dropped()
+		return false
+	}
+
+	policy := s.overflowPolicy()
+	if messages != nil && !send(messages, m, policy, s.channels.done, s.dropped) {
+		s.overflow()
+		return false
+	}
+	if events != nil && !send(events, SubEvent{Type: SubEventMessage, Message: m}, policy, s.channels.done, s.dropped) {
+		s.overflow()
+		return false
+	}
+	return true
+}
+
+func (s *Sub) sendEvent(event SubEvent, targets subTargets) {
+	_, events, ok := s.beginSend(targets)
+	if !ok {
+		return
+	}
+	defer s.endSend()
+	if events != nil && !send(events, event, s.overflowPolicy(), s.channels.done, s.dropped) {
+		s.overflow()
+	}
+}
+
+// overflow drops connection for OverflowDisconnect policy.
+func (s *Sub) overflow() {
+	s.channels.mutex.Lock()
+	s.channels.overflowed = true
+	s.channels.mutex.Unlock()
+	s.centrifuge.log(LogLevelWarn, "dropping connection", "channel", s.Channel, "error", ErrSubBufferOverflow)
+	s.centrifuge.dropConnection()
+}
+
+// dropped reports value dropped from subscription channels.
+func (s *Sub) dropped() {
+	if s.centrifuge != nil {
+		s.centrifuge.observeDropped(s.Channel)
+	}
+}
+
+// resetOverflow lets messages through again, lost ones are recovered by
+// resubscribe.
+func (s *Sub) resetOverflow() {
+	s.channels.mutex.Lock()
+	s.channels.overflowed = false
+	s.channels.mutex.Unlock()
+}
+
+// closeChannels sends unsubscribe event and closes channels.
+func (s *Sub) closeChannels(reason UnsubscribeReason) {
+	s.channels.mutex.Lock()
+	if s.channels.closed {
+		s.channels.mutex.Unlock()
+		return
+	}
+	s.channels.closed = true
+	s.channels.init()
+	close(s.channels.done)
+	messages, events := s.channels.messages, s.channels.events
+	s.channels.mutex.Unlock()
+
+	// Wait for blocked senders released by done.
+	s.channels.sending.Wait()
+
+	if events != nil {
+		select {
+		case events <- SubEvent{Type: SubEventUnsubscribe, Reason: reason}:
+		default:
+		}
+		close(events)
+	}
+	if messages != nil {
+		close(messages)
+	}
+}
+
+// send passes v into ch according to policy. It returns false when
+// OverflowDisconnect policy must drop connection. dropped is called for
+// every value lost, v or older one.
+func send[T any](ch chan T, v T, policy OverflowPolicy, done <-chan struct{}, dropped func()) bool {
+	select {
+	case ch <- v:
+		return true
+	default:
+	}
+	switch policy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case ch <- v:
+				return true
+			default:
+			}
+			select {
+			case <-ch:
+				dropped()
+			default:
+			}
+		}
+	case OverflowDropNewest:
+		dropped()
+		return true
+	case OverflowDisconnect:
+		dropped()
+		return false
+	default:
+		select {
+		case ch <- v:
+		case <-done:
+		}
+		return true
+	}
+}
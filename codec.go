@@ -0,0 +1,216 @@
+package centrifuge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes commands sent to server and decodes replies. Command
+// params and reply bodies are encoded separately with the same codec and
+// carried inside command and reply as raw values, binary codecs keep them
+// as byte strings.
+type Codec interface {
+	// Name identifies codec, e.g. "json".
+	Name() string
+	// Binary reports whether frames must be sent as binary messages, such
+	// codecs require connection implementing BinaryConnection.
+	Binary() bool
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// EncodeFrame joins encoded commands into one frame.
+	EncodeFrame(msgs [][]byte) []byte
+	// JoinFrames joins frames returned by EncodeFrame into one frame.
+	JoinFrames(frames [][]byte) []byte
+	// DecodeFrame splits frame received from server into encoded replies.
+	DecodeFrame(frame []byte) ([][]byte, error)
+}
+
+var (
+	// JSONCodec is Centrifugo JSON protocol, used when Config.Codec is
+	// not set. Several commands are sent as one JSON array.
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec encodes commands with MessagePack. Each command in
+	// frame is prefixed with its length as unsigned varint.
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+var ErrMalformedFrame = errors.New("malformed frame")
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) EncodeFrame(msgs [][]byte) []byte {
+	return arrayFrame(msgs)
+}
+
+func (jsonCodec) JoinFrames(frames [][]byte) []byte {
+	return arrayFrame(frames)
+}
+
+func (jsonCodec) DecodeFrame(frame []byte) ([][]byte, error) {
+	switch frame[0] {
+	case objectJsonPrefix:
+		// single reply
+		return [][]byte{frame}, nil
+	case arrayJsonPrefix:
+		// array of replies received
+		var raws []json.RawMessage
+		err := json.Unmarshal(frame, &raws)
+		if err != nil {
+			return nil, err
+		}
+		msgs := make([][]byte, len(raws))
+		for i, raw := range raws {
+			msgs[i] = raw
+		}
+		return msgs, nil
+	default:
+		return nil, ErrUnexpectedMessageData
+	}
+}
+
+// arrayFrame joins JSON encoded commands into one array frame. Commands
+// which are already array frames are spliced in.
+func arrayFrame(msgs [][]byte) []byte {
+	if len(msgs) == 1 {
+		return msgs[0]
+	}
+	size := len(msgs) + 1
+	for _, msg := range msgs {
+		size += len(msg)
+	}
+	frame := make([]byte, 0, size)
+	frame = append(frame, arrayJsonPrefix)
+	for i, msg := range msgs {
+		if i > 0 {
+			frame = append(frame, ',')
+		}
+		if len(msg) > 1 && msg[0] == arrayJsonPrefix {
+			msg = msg[1 : len(msg)-1]
+		}
+		frame = append(frame, msg...)
+	}
+	return append(frame, ']')
+}
+
+var (
+	arrayJsonPrefix  byte = '['
+	objectJsonPrefix byte = '{'
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+// Marshal uses json struct tags, so libcentrifugo types keep field names.
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func (msgpackCodec) EncodeFrame(msgs [][]byte) []byte {
+	size := 0
+	for _, msg := range msgs {
+		size += binary.MaxVarintLen64 + len(msg)
+	}
+	frame := make([]byte, 0, size)
+	for _, msg := range msgs {
+		frame = binary.AppendUvarint(frame, uint64(len(msg)))
+		frame = append(frame, msg...)
+	}
+	return frame
+}
+
+func (msgpackCodec) JoinFrames(frames [][]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+func (msgpackCodec) DecodeFrame(frame []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(frame) > 0 {
+		size, n := binary.Uvarint(frame)
+		if n <= 0 || uint64(len(frame)-n) < size {
+			return nil, ErrMalformedFrame
+		}
+		frame = frame[n:]
+		msgs = append(msgs, frame[:size])
+		frame = frame[size:]
+	}
+	return msgs, nil
+}
+
+// codec returns Config.Codec or JSONCodec when not set.
+func (c *centrifugeImpl) codec() Codec {
+	if c.config == nil || c.config.Codec == nil {
+		return JSONCodec
+	}
+	return c.config.Codec
+}
+
+// encodeCommand encodes cmd into frame with one command.
+func (c *centrifugeImpl) encodeCommand(cmd clientCommand) ([]byte, error) {
+	codec := c.codec()
+	params, err := codec.Marshal(cmd.Params)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Params = json.RawMessage(params)
+	msg, err := codec.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return codec.EncodeFrame([][]byte{msg}), nil
+}
+
+func (c *centrifugeImpl) decodeResponses(frame []byte) ([]response, error) {
+	codec := c.codec()
+	msgs, err := codec.DecodeFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	resps := make([]response, len(msgs))
+	for i, msg := range msgs {
+		err := codec.Unmarshal(msg, &resps[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resps, nil
+}
@@ -1,9 +1,13 @@
 package centrifuge
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"net/http"
+	neturl "net/url"
+	"sync"
 	"time"
 )
 
@@ -13,42 +17,180 @@ type Connection interface {
 	ReadMessage() ([]byte, error)
 }
 
-type ConnectionFactory func(string, time.Duration) (Connection, error)
+// BinaryConnection is a connection able to send binary frames, binary
+// codecs require it.
+type BinaryConnection interface {
+	Connection
+	WriteBinaryMessage([]byte) error
+}
+
+// ConnectionFactory dials url and returns established connection. ctx is
+// context passed to ConnectContext, dial must give up when it is done.
+type ConnectionFactory func(ctx context.Context, url string, writeTimeout time.Duration) (Connection, error)
 
 // ------------------------
 // Websocket implementation
 // ------------------------
 
+// WSConfig contains websocket transport options.
+type WSConfig struct {
+	// Header is sent with handshake request, e.g. cookies or Authorization.
+	Header http.Header
+	// TLSConfig is used for wss:// connections, e.g. to set client
+	// certificates or custom root CAs.
+	TLSConfig *tls.Config
+	// Proxy returns proxy URL for handshake request, nil means
+	// http.ProxyFromEnvironment.
+	Proxy func(*http.Request) (*neturl.URL, error)
+	// HandshakeTimeout is DefaultHandshakeTimeout when not set.
+	HandshakeTimeout time.Duration
+	Subprotocols     []string
+	// EnableCompression negotiates per message compression with server.
+	EnableCompression bool
+	// ReadLimit is maximum size of incoming message, zero means no limit.
+	ReadLimit       int64
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// PingInterval makes connection send ping frame every PingInterval.
+	// ReadMessage fails when nothing, pong included, was received from
+	// server during PongWait, so half-open connections are detected.
+	// PongWait is 2*PingInterval when not set or not greater than
+	// PingInterval. Zero PingInterval disables pings.
+	PingInterval time.Duration
+	PongWait     time.Duration
+}
+
+// DefaultHandshakeTimeout matches websocket.DefaultDialer.
+const DefaultHandshakeTimeout = 45 * time.Second
+
 type wsConnection struct {
 	conn         *websocket.Conn
 	writeTimeout time.Duration
+	pongWait     time.Duration
+	closeOnce    sync.Once
+	closed       chan struct{}
+}
+
+func NewWSConnection(ctx context.Context, url string, writeTimeout time.Duration) (Connection, error) {
+	return NewWSConnectionFactory(&WSConfig{})(ctx, url, writeTimeout)
+}
+
+// NewWSHeartbeatFactory returns ConnectionFactory for websocket connections
+// with WSConfig.PingInterval and WSConfig.PongWait set.
+func NewWSHeartbeatFactory(pingInterval, pongWait time.Duration) ConnectionFactory {
+	return NewWSConnectionFactory(&WSConfig{PingInterval: pingInterval, PongWait: pongWait})
+}
+
+// NewWSConnectionFactory returns ConnectionFactory for websocket connections
+// configured with config. Pass it as Config.ConnectionFactory.
+func NewWSConnectionFactory(config *WSConfig) ConnectionFactory {
+	return func(ctx context.Context, url string, writeTimeout time.Duration) (Connection, error) {
+		conn, err := dialWS(ctx, url, config)
+		if err != nil {
+			return nil, err
+		}
+		c := &wsConnection{
+			conn:         conn,
+			writeTimeout: writeTimeout,
+			closed:       make(chan struct{}),
+		}
+		if config.ReadLimit > 0 {
+			conn.SetReadLimit(config.ReadLimit)
+		}
+		if config.PingInterval > 0 {
+			pongWait := config.PongWait
+			if pongWait <= config.PingInterval {
+				pongWait = 2 * config.PingInterval
+			}
+			c.pongWait = pongWait
+			conn.SetReadDeadline(time.Now().Add(pongWait))
+			conn.SetPongHandler(func(string) error {
+				return conn.SetReadDeadline(time.Now().Add(pongWait))
+			})
+			go c.ping(config.PingInterval)
+		}
+		return c, nil
+	}
 }
 
-func NewWSConnection(url string, writeTimeout time.Duration) (Connection, error) {
+func dialWS(ctx context.Context, url string, config *WSConfig) (*websocket.Conn, error) {
+	dialer := &websocket.Dialer{
+		Proxy:             config.Proxy,
+		TLSClientConfig:   config.TLSConfig,
+		HandshakeTimeout:  config.HandshakeTimeout,
+		Subprotocols:      config.Subprotocols,
+		EnableCompression: config.EnableCompression,
+		ReadBufferSize:    config.ReadBufferSize,
+		WriteBufferSize:   config.WriteBufferSize,
+	}
+	if dialer.Proxy == nil {
+		dialer.Proxy = http.ProxyFromEnvironment
+	}
+	if dialer.HandshakeTimeout == 0 {
+		dialer.HandshakeTimeout = DefaultHandshakeTimeout
+	}
 	wsHeaders := http.Header{}
-	dialer := websocket.DefaultDialer
-	conn, resp, err := dialer.Dial(url, wsHeaders)
+	for k, v := range config.Header {
+		wsHeaders[k] = v
+	}
+	conn, resp, err := dialer.DialContext(ctx, url, wsHeaders)
 	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%s: server responded with status code '%d'", err, resp.StatusCode)
+		}
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
 		return nil, fmt.Errorf("Wrong status code while connecting to server: '%d'", resp.StatusCode)
 	}
-	return &wsConnection{conn: conn, writeTimeout: writeTimeout}, nil
+	return conn, nil
+}
+
+func (c *wsConnection) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeTimeout))
+			if err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
 }
 
 func (c *wsConnection) Close() {
-	c.conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
 }
 
 func (c *wsConnection) WriteMessage(msg []byte) error {
+	return c.write(websocket.TextMessage, msg)
+}
+
+func (c *wsConnection) WriteBinaryMessage(msg []byte) error {
+	return c.write(websocket.BinaryMessage, msg)
+}
+
+func (c *wsConnection) write(messageType int, msg []byte) error {
 	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
-	err := c.conn.WriteMessage(websocket.TextMessage, msg)
+	err := c.conn.WriteMessage(messageType, msg)
 	c.conn.SetWriteDeadline(time.Time{})
 	return err
 }
 
 func (c *wsConnection) ReadMessage() ([]byte, error) {
 	_, message, err := c.conn.ReadMessage()
+	if err == nil && c.pongWait > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.pongWait))
+	}
 	return message, err
 }
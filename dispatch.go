@@ -0,0 +1,127 @@
+package centrifuge
+
+import (
+	"sync"
+)
+
+// DefaultDispatchQueueSize is number of messages, join and leave events
+// queued per subscription while its handlers are busy.
+const DefaultDispatchQueueSize = 1024
+
+// dispatcher runs subscription handlers on separate goroutine, so slow
+// handlers do not stall reading from connection and replies to commands.
+// Events of one subscription are handled in order. Goroutine is started
+// when event is queued and exits when queue is empty.
+type dispatcher struct {
+	mutex   sync.Mutex
+	queue   []dispatchTask
+	limited int
+	running bool
+}
+
+// dispatchTask is limited when it counts against queue size and may be
+// dropped. Recovery and unsubscribe are never dropped.
+type dispatchTask struct {
+	fn      func()
+	limited bool
+}
+
+// dispatch queues fn. When queue of limited tasks is full
+// Config.DispatchOverflowPolicy applies. It never blocks, caller is
+// goroutine reading replies.
+func (s *Sub) dispatch(fn func(), limited bool) {
+	c := s.centrifuge
+	if c == nil {
+		fn()
+		return
+	}
+	d := &s.dispatcher
+	d.mutex.Lock()
+	if limited {
+		if d.limited >= c.dispatchQueueSize() {
+			switch c.dispatchOverflowPolicy() {
+			case OverflowDropOldest:
+				d.dropOldest()
+				c.observeDropped(s.Channel)
+				c.log(LogLevelWarn, "dispatch queue full, oldest event dropped", "channel", s.Channel)
+			case OverflowDropNewest:
+				d.mutex.Unlock()
+				c.observeDropped(s.Channel)
+				c.log(LogLevelWarn, "dispatch queue full, event dropped", "channel", s.Channel)
+				return
+			default:
+				d.mutex.Unlock()
+				c.observeDropped(s.Channel)
+				s.overflow()
+				return
+			}
+		}
+		d.limited++
+	}
+	d.queue = append(d.queue, dispatchTask{fn: fn, limited: limited})
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+	d.mutex.Unlock()
+}
+
+// Lock must be held outside
+func (d *dispatcher) dropOldest() {
+	for i, task := range d.queue {
+		if task.limited {
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			d.limited--
+			return
+		}
+	}
+}
+
+func (d *dispatcher) run() {
+	for {
+		d.mutex.Lock()
+		if len(d.queue) == 0 {
+			d.running = false
+			d.mutex.Unlock()
+			return
+		}
+		task := d.queue[0]
+		d.queue[0] = dispatchTask{}
+		d.queue = d.queue[1:]
+		if task.limited {
+			d.limited--
+		}
+		d.mutex.Unlock()
+		task.fn()
+	}
+}
+
+func (c *centrifugeImpl) dispatchQueueSize() int {
+	if c.config.DispatchQueueSize <= 0 {
+		return DefaultDispatchQueueSize
+	}
+	return c.config.DispatchQueueSize
+}
+
+// dispatchOverflowPolicy is OverflowDisconnect unless dropping is
+// configured, OverflowBlock would stall replies and pings.
+func (c *centrifugeImpl) dispatchOverflowPolicy() OverflowPolicy {
+	switch c.config.DispatchOverflowPolicy {
+	case OverflowDropOldest, OverflowDropNewest:
+		return c.config.DispatchOverflowPolicy
+	}
+	return OverflowDisconnect
+}
+
+// dropConnection closes connection, so client handles it as lost. It does
+// not wait for lock, caller may be the goroutine handleDisconnect waits for.
+func (c *centrifugeImpl) dropConnection() {
+	go func() {
+		c.mutex.RLock()
+		conn := c.conn
+		c.mutex.RUnlock()
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+}
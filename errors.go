@@ -0,0 +1,149 @@
+package centrifuge
+
+import (
+	"context"
+	"errors"
+)
+
+// Errors returned by server, ServerError matches them with errors.Is.
+// ErrAlreadySubscribed is also returned by client itself when it already
+// has Sub on channel.
+var (
+	ErrInvalidMessage      = errors.New("invalid message")
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrMethodNotFound      = errors.New("method not found")
+	ErrPermissionDenied    = errors.New("permission denied")
+	ErrNamespaceNotFound   = errors.New("namespace not found")
+	ErrInternalServerError = errors.New("internal server error")
+	ErrAlreadySubscribed   = errors.New("already subscribed")
+	ErrLimitExceeded       = errors.New("limit exceeded")
+	ErrNotAvailable        = errors.New("not available")
+	ErrSendTimeout         = errors.New("send timeout")
+	ErrClientClosed        = errors.New("client is closed")
+)
+
+// ServerErrorCode is a kind of error returned by server.
+type ServerErrorCode int
+
+const (
+	ServerErrorUnknown = ServerErrorCode(iota)
+	ServerErrorInvalidMessage
+	ServerErrorInvalidToken
+	ServerErrorUnauthorized
+	ServerErrorMethodNotFound
+	ServerErrorPermissionDenied
+	ServerErrorNamespaceNotFound
+	ServerErrorInternal
+	ServerErrorAlreadySubscribed
+	ServerErrorLimitExceeded
+	ServerErrorNotAvailable
+	ServerErrorSendTimeout
+	ServerErrorClientClosed
+)
+
+var serverErrors = map[ServerErrorCode]error{
+	ServerErrorInvalidMessage:    ErrInvalidMessage,
+	ServerErrorInvalidToken:      ErrInvalidToken,
+	ServerErrorUnauthorized:      ErrUnauthorized,
+	ServerErrorMethodNotFound:    ErrMethodNotFound,
+	ServerErrorPermissionDenied:  ErrPermissionDenied,
+	ServerErrorNamespaceNotFound: ErrNamespaceNotFound,
+	ServerErrorInternal:          ErrInternalServerError,
+	ServerErrorAlreadySubscribed: ErrAlreadySubscribed,
+	ServerErrorLimitExceeded:     ErrLimitExceeded,
+	ServerErrorNotAvailable:      ErrNotAvailable,
+	ServerErrorSendTimeout:       ErrSendTimeout,
+	ServerErrorClientClosed:      ErrClientClosed,
+}
+
+// String returns error message server sends for code.
+func (code ServerErrorCode) String() string {
+	if err, ok := serverErrors[code]; ok {
+		return err.Error()
+	}
+	return "unknown"
+}
+
+// ParseServerErrorCode returns code of error message sent by server,
+// ServerErrorUnknown when message is not known.
+func ParseServerErrorCode(message string) ServerErrorCode {
+	for code, err := range serverErrors {
+		if err.Error() == message {
+			return code
+		}
+	}
+	return ServerErrorUnknown
+}
+
+// ServerError is error returned by server in reply to command.
+type ServerError struct {
+	Method  string
+	UID     string
+	Message string
+	Code    ServerErrorCode
+}
+
+func newServerError(r response) *ServerError {
+	return &ServerError{
+		Method:  r.Method,
+		UID:     r.UID,
+		Message: r.Error,
+		Code:    ParseServerErrorCode(r.Error),
+	}
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// Is matches error with sentinel of its code, e.g. ErrPermissionDenied.
+func (e *ServerError) Is(target error) bool {
+	err, ok := serverErrors[e.Code]
+	return ok && err == target
+}
+
+// Temporary reports whether error is caused by server state rather than
+// command, so the same command may succeed later.
+func (e *ServerError) Temporary() bool {
+	switch e.Code {
+	case ServerErrorInternal, ServerErrorNotAvailable, ServerErrorSendTimeout, ServerErrorClientClosed:
+		return true
+	}
+	return false
+}
+
+// Retryable reports whether command can be sent again safely. Publish is
+// not retryable when it may have been applied before error happened.
+func (e *ServerError) Retryable() bool {
+	if !e.Temporary() {
+		return false
+	}
+	if e.Method == "publish" {
+		return e.Code == ServerErrorNotAvailable || e.Code == ServerErrorClientClosed
+	}
+	return true
+}
+
+// IsRetryable reports whether command failed with err can be sent again
+// safely, after reconnect when connection was lost. It is false for
+// ErrTimeout and ErrWaiterClosed, command was sent then and may have been
+// applied by server, e.g. publish retried would be published twice.
+func IsRetryable(err error) bool {
+	var serr *ServerError
+	if errors.As(err, &serr) {
+		return serr.Retryable()
+	}
+	return errors.Is(err, ErrClientDisconnected)
+}
+
+// connectionError reports whether err means connection is lost rather than
+// server rejected command.
+func connectionError(err error) bool {
+	for _, target := range []error{ErrTimeout, ErrClientDisconnected, ErrWaiterClosed, context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -108,7 +108,7 @@ func main() {
 
 	started := time.Now()
 	for i := 0; i < numPublish; i++ {
-		go sub.Publish(dataBytes)
+		sub.PublishAsync(dataBytes, nil)
 	}
 	<-done
 	elapsed := time.Since(started)
@@ -0,0 +1,113 @@
+package centrifuge
+
+import (
+	"time"
+)
+
+const (
+	DefaultHandlerRetries    = 3
+	DefaultHandlerRetryDelay = 100 * time.Millisecond
+)
+
+// HandlerErrorPolicy decides what happens when handler of SubEventHandler
+// returns error, e.g. OnMessage or OnSubscribeError.
+type HandlerErrorPolicy int
+
+const (
+	// HandlerErrorLog logs error and goes on with next event.
+	HandlerErrorLog = HandlerErrorPolicy(iota)
+	// HandlerErrorReport passes *HandlerError to EventHandler.OnError, it
+	// is logged when OnError is not set.
+	HandlerErrorReport
+	// HandlerErrorUnsubscribe unsubscribes from channel, e.g. when handler
+	// can not process messages any more.
+	HandlerErrorUnsubscribe
+	// HandlerErrorRetry calls handler again with the same event up to
+	// Config.HandlerRetries times, doubling Config.HandlerRetryDelay
+	// between attempts. Next events of subscription wait meanwhile. Error
+	// of last attempt is reported as with HandlerErrorReport.
+	HandlerErrorRetry
+)
+
+// HandlerError is error returned from subscription handler.
+type HandlerError struct {
+	Channel string
+	Event   SubEventType
+	Err     error
+}
+
+func (e *HandlerError) Error() string {
+	return e.Event.String() + " handler failed on channel " + e.Channel + ": " + e.Err.Error()
+}
+
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// handle calls handler of event and applies Config.HandlerErrorPolicy when
+// it fails.
+func (s *Sub) handle(event SubEventType, handler func() error) {
+	err := handler()
+	c := s.centrifuge
+	if err == nil || c == nil {
+		return
+	}
+	herr := &HandlerError{Channel: s.Channel, Event: event, Err: err}
+
+	switch c.config.HandlerErrorPolicy {
+	case HandlerErrorReport:
+		c.reportHandlerError(herr)
+	case HandlerErrorUnsubscribe:
+		c.log(LogLevelWarn, "unsubscribing on handler error", "channel", s.Channel, "error", herr)
+		if event == SubEventUnsubscribe {
+			return
+		}
+		err := s.Unsubscribe()
+		if err != nil {
+			c.log(LogLevelError, "unsubscribe failed", "channel", s.Channel, "error", err)
+		}
+	case HandlerErrorRetry:
+		delay := c.handlerRetryDelay()
+		for i := 0; i < c.handlerRetries(); i++ {
+			time.Sleep(delay)
+			delay *= 2
+			if event != SubEventUnsubscribe && s.State() == SubUnsubscribed {
+				return
+			}
+			err = handler()
+			if err == nil {
+				return
+			}
+			herr.Err = err
+		}
+		c.reportHandlerError(herr)
+	default:
+		c.log(LogLevelWarn, "handler failed", "channel", s.Channel, "error", herr)
+	}
+}
+
+func (c *centrifugeImpl) reportHandlerError(err *HandlerError) {
+	var onError ErrorHandler
+	if c.events != nil && c.events.OnError != nil {
+		onError = c.events.OnError
+	}
+	if onError != nil {
+		onError(c, err)
+	} else {
+		c.log(LogLevelError, "handler failed", "channel", err.Channel, "error", err)
+	}
+}
+
+func (c *centrifugeImpl) handlerRetries() int {
+	if c.config.HandlerRetries <= 0 {
+		return DefaultHandlerRetries
+	}
+	return c.config.HandlerRetries
+}
+
+func (c *centrifugeImpl) handlerRetryDelay() time.Duration {
+	if c.config.HandlerRetryDelay <= 0 {
+		return DefaultHandlerRetryDelay
+	}
+	return c.config.HandlerRetryDelay
+}
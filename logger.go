@@ -0,0 +1,83 @@
+package centrifuge
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogLevel is a severity of client log entry.
+type LogLevel int
+
+const (
+	LogLevelDebug = LogLevel(iota)
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// String returns lowercase level name.
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Logger receives client diagnostics. Fields are alternating key/value
+// pairs, e.g. Log(LogLevelWarn, "reconnect failed", "error", err).
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...interface{})
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Log(LogLevel, string, ...interface{}) {}
+
+// NoopLogger discards everything. Nil Config.Logger behaves the same way.
+var NoopLogger Logger = noopLogger{}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger adapts *slog.Logger to Logger interface.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger: logger}
+}
+
+func (l *slogLogger) Log(level LogLevel, msg string, fields ...interface{}) {
+	l.logger.Log(context.Background(), slogLevel(level), msg, fields...)
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelInfo:
+		return slog.LevelInfo
+	case LogLevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// log sends entry to configured Logger. Debug entries are only passed
+// through when Config.Debug is set.
+func (c *centrifugeImpl) log(level LogLevel, msg string, fields ...interface{}) {
+	if c.config == nil || c.config.Logger == nil {
+		return
+	}
+	if level == LogLevelDebug && !c.config.Debug {
+		return
+	}
+	c.config.Logger.Log(level, msg, fields...)
+}
@@ -0,0 +1,117 @@
+package centrifuge
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Outcome is a result of command, reconnect attempt or refresh reported to
+// Metrics.
+type Outcome string
+
+const (
+	OutcomeOK           = Outcome("ok")
+	OutcomeError        = Outcome("error")
+	OutcomeTimeout      = Outcome("timeout")
+	OutcomeDisconnected = Outcome("disconnected")
+	OutcomeCanceled     = Outcome("canceled")
+	OutcomeExpired      = Outcome("expired")
+)
+
+// Queues reported to Metrics.SetQueueDepth.
+const (
+	QueueReceive = "receive"
+	QueueWrite   = "write"
+)
+
+// Metrics collects measurements of client internals, package centrifugeprom
+// has Prometheus adapter. Methods are called from client goroutines, they
+// must be safe for concurrent use and must not block.
+type Metrics interface {
+	// ObserveCommand is called when reply to command is received or
+	// waiting for it failed.
+	ObserveCommand(method string, outcome Outcome, latency time.Duration)
+	// SetQueueDepth reports number of frames waiting in QueueReceive or
+	// QueueWrite.
+	SetQueueDepth(queue string, depth int)
+	// IncReconnect is called after every reconnect attempt.
+	IncReconnect(outcome Outcome)
+	// IncRefresh is called after every credentials refresh made by client.
+	IncRefresh(outcome Outcome)
+	// IncMessage is called for every message of channel delivered to
+	// subscription channels and OnMessage handler.
+	IncMessage(channel string)
+	// IncDropped is called for every message, join or leave event of
+	// channel dropped because dispatch queue or subscription channel is
+	// full, see Config.DispatchOverflowPolicy and Config.SubOverflowPolicy.
+	IncDropped(channel string)
+}
+
+// outcome classifies err for Metrics.
+func outcome(err error) Outcome {
+	var serr *ServerError
+	switch {
+	case err == nil:
+		return OutcomeOK
+	case errors.As(err, &serr):
+		return OutcomeError
+	case errors.Is(err, ErrClientExpired):
+		return OutcomeExpired
+	case errors.Is(err, ErrTimeout):
+		return OutcomeTimeout
+	case errors.Is(err, ErrClientDisconnected), errors.Is(err, ErrWaiterClosed):
+		return OutcomeDisconnected
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return OutcomeCanceled
+	default:
+		return OutcomeError
+	}
+}
+
+// observeCommand reports command sent at start, err is error of waiting
+// for reply r.
+func (c *centrifugeImpl) observeCommand(method string, start time.Time, r response, err error) {
+	if c.config.Metrics == nil {
+		return
+	}
+	if err == nil && r.Error != "" {
+		err = newServerError(r)
+	}
+	c.config.Metrics.ObserveCommand(method, outcome(err), time.Since(start))
+}
+
+func (c *centrifugeImpl) observeQueue(queue string, ch chan []byte) {
+	if c.config.Metrics == nil {
+		return
+	}
+	c.config.Metrics.SetQueueDepth(queue, len(ch))
+}
+
+func (c *centrifugeImpl) observeReconnect(err error) {
+	if c.config.Metrics == nil {
+		return
+	}
+	c.config.Metrics.IncReconnect(outcome(err))
+}
+
+func (c *centrifugeImpl) observeRefresh(err error) {
+	if c.config.Metrics == nil {
+		return
+	}
+	c.config.Metrics.IncRefresh(outcome(err))
+}
+
+func (c *centrifugeImpl) observeMessage(channel string) {
+	if c.config.Metrics == nil {
+		return
+	}
+	c.config.Metrics.IncMessage(channel)
+}
+
+func (c *centrifugeImpl) observeDropped(channel string) {
+	if c.config.Metrics == nil {
+		return
+	}
+	c.config.Metrics.IncDropped(channel)
+}
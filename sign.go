@@ -0,0 +1,120 @@
+package centrifuge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoPrivateSigner    = errors.New("PrivateSubHandler must be set to handle private channel subscriptions")
+	ErrPrivateSignMissing = errors.New("private channel sign missing")
+)
+
+// PrivateSignProvider signs all private channels client subscribes on at
+// once, e.g. with one request to batched auth endpoint of backend.
+// Channels missing from returned map fail with ErrPrivateSignMissing.
+type PrivateSignProvider interface {
+	SignPrivateChannels(ctx context.Context, clientID string, channels []string) (map[string]*PrivateSign, error)
+}
+
+// PrivateSignProviderFunc adapts function to PrivateSignProvider.
+type PrivateSignProviderFunc func(ctx context.Context, clientID string, channels []string) (map[string]*PrivateSign, error)
+
+func (f PrivateSignProviderFunc) SignPrivateChannels(ctx context.Context, clientID string, channels []string) (map[string]*PrivateSign, error) {
+	return f(ctx, clientID, channels)
+}
+
+// signCache keeps signs received for current client ID. Sign is only valid
+// for client ID it was made for, so cache is dropped when ID changes.
+type signCache struct {
+	mutex    sync.Mutex
+	clientID string
+	signs    map[string]*PrivateSign
+}
+
+// Lock must be held outside
+func (c *signCache) reset(clientID string) {
+	if c.signs == nil || c.clientID != clientID {
+		c.clientID = clientID
+		c.signs = make(map[string]*PrivateSign)
+	}
+}
+
+func (c *signCache) get(clientID, channel string) (*PrivateSign, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reset(clientID)
+	sign, ok := c.signs[channel]
+	return sign, ok
+}
+
+func (c *signCache) set(clientID, channel string, sign *PrivateSign) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reset(clientID)
+	c.signs[channel] = sign
+}
+
+func (c *signCache) remove(channel string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.signs, channel)
+}
+
+// signPrivate sets privateSign of subs on private channels using cache,
+// OnPrivateSub of sub or Config.PrivateSignProvider for all the rest in
+// one call. It returns error for every sub which was not signed.
+func (c *centrifugeImpl) signPrivate(ctx context.Context, subs []*Sub) []error {
+	errs := make([]error, len(subs))
+	clientID := string(c.clientID)
+	var batch []int
+	for i, sub := range subs {
+		if !strings.HasPrefix(sub.Channel, c.config.PrivateChannelPrefix) {
+			continue
+		}
+		if sign, ok := c.signs.get(clientID, sub.Channel); ok {
+			sub.privateSign = sign
+			continue
+		}
+		if sub.events != nil && sub.events.OnPrivateSub != nil {
+			sign, err := sub.events.OnPrivateSub(c, newPrivateRequest(clientID, sub.Channel))
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			c.signs.set(clientID, sub.Channel, sign)
+			sub.privateSign = sign
+			continue
+		}
+		if c.config.PrivateSignProvider == nil {
+			errs[i] = ErrNoPrivateSigner
+			continue
+		}
+		batch = append(batch, i)
+	}
+	if len(batch) == 0 {
+		return errs
+	}
+
+	channels := make([]string, len(batch))
+	for j, i := range batch {
+		channels[j] = subs[i].Channel
+	}
+	signs, err := c.config.PrivateSignProvider.SignPrivateChannels(ctx, clientID, channels)
+	for _, i := range batch {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		sign := signs[subs[i].Channel]
+		if sign == nil {
+			errs[i] = ErrPrivateSignMissing
+			continue
+		}
+		c.signs.set(clientID, subs[i].Channel, sign)
+		subs[i].privateSign = sign
+	}
+	return errs
+}
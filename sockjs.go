@@ -0,0 +1,356 @@
+package centrifuge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SockJS transports supported by SockJS connection.
+const (
+	SockJSXHRStreaming = "xhr_streaming"
+	SockJSXHRPolling   = "xhr"
+)
+
+var (
+	ErrSockJSClosed          = errors.New("sockjs session closed")
+	ErrSockJSNoTransport     = errors.New("no sockjs transport available")
+	ErrSockJSUnexpectedFrame = errors.New("unexpected sockjs frame")
+)
+
+// SockJSConfig contains SockJS transport options.
+type SockJSConfig struct {
+	// URL of SockJS endpoint, e.g. http://localhost:8000/connection. When
+	// empty it is derived from websocket URL passed to factory: ws and wss
+	// schemes become http and https and trailing /websocket is dropped.
+	URL string
+	// Transports are tried in order, SockJSXHRStreaming and then
+	// SockJSXHRPolling when not set.
+	Transports []string
+	// Header is sent with every request.
+	Header http.Header
+	// Client makes HTTP requests, http.DefaultClient when nil. Configure
+	// its Transport to set TLS options or proxy.
+	Client *http.Client
+	// HandshakeTimeout bounds opening session with each transport, it is
+	// DefaultHandshakeTimeout when not set.
+	HandshakeTimeout time.Duration
+}
+
+// NewSockJSConnectionFactory returns ConnectionFactory for SockJS
+// xhr-streaming and xhr-polling transports, for networks where websocket
+// upgrade is not possible.
+func NewSockJSConnectionFactory(config *SockJSConfig) ConnectionFactory {
+	return func(ctx context.Context, url string, writeTimeout time.Duration) (Connection, error) {
+		base := config.URL
+		if base == "" {
+			base = sockjsURL(url)
+		}
+		transports := config.Transports
+		if len(transports) == 0 {
+			transports = []string{SockJSXHRStreaming, SockJSXHRPolling}
+		}
+		client := config.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+
+		handshakeTimeout := config.HandshakeTimeout
+		if handshakeTimeout == 0 {
+			handshakeTimeout = DefaultHandshakeTimeout
+		}
+
+		err := ErrSockJSNoTransport
+		for _, transport := range transports {
+			var conn *sockjsConnection
+			dialCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+			conn, err = dialSockJS(dialCtx, client, config.Header, base, transport, writeTimeout)
+			cancel()
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// NewFallbackConnectionFactory returns ConnectionFactory which tries
+// factories in order and returns first established connection, e.g.
+// websocket first and SockJS when websocket is blocked:
+//
+//	NewFallbackConnectionFactory(NewWSConnection, NewSockJSConnectionFactory(&SockJSConfig{}))
+func NewFallbackConnectionFactory(factories ...ConnectionFactory) ConnectionFactory {
+	return func(ctx context.Context, url string, writeTimeout time.Duration) (Connection, error) {
+		var errs []error
+		for _, factory := range factories {
+			conn, err := factory(ctx, url, writeTimeout)
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+func sockjsURL(url string) string {
+	switch {
+	case strings.HasPrefix(url, "ws://"):
+		url = "http://" + strings.TrimPrefix(url, "ws://")
+	case strings.HasPrefix(url, "wss://"):
+		url = "https://" + strings.TrimPrefix(url, "wss://")
+	}
+	return strings.TrimSuffix(url, "/websocket")
+}
+
+const sockjsSessionIDChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+func sockjsSessionURL(base string) string {
+	session := make([]byte, 8)
+	for i := range session {
+		session[i] = sockjsSessionIDChars[rand.Intn(len(sockjsSessionIDChars))]
+	}
+	server := strconv.Itoa(rand.Intn(1000))
+	return strings.TrimSuffix(base, "/") + "/" + server + "/" + string(session)
+}
+
+type sockjsConnection struct {
+	client       *http.Client
+	header       http.Header
+	sessionURL   string
+	transport    string
+	writeTimeout time.Duration
+
+	messages  chan []byte
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+	errOnce   sync.Once
+	closeOnce sync.Once
+}
+
+func dialSockJS(dialCtx context.Context, client *http.Client, header http.Header, base, transport string, writeTimeout time.Duration) (*sockjsConnection, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &sockjsConnection{
+		client:       client,
+		header:       header,
+		sessionURL:   sockjsSessionURL(base),
+		transport:    transport,
+		writeTimeout: writeTimeout,
+		messages:     make(chan []byte, 64),
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+
+	// ctx outlives dial for streaming response, dialCtx only aborts handshake.
+	stop := context.AfterFunc(dialCtx, cancel)
+	defer stop()
+
+	resp, err := c.post(ctx, transport, nil)
+	if err != nil {
+		cancel()
+		return nil, dialError(dialCtx, err)
+	}
+	reader := bufio.NewReader(resp.Body)
+	// Wait for open frame, streaming response starts with heartbeat prelude.
+	for {
+		frame, err := reader.ReadString('\n')
+		if err != nil {
+			resp.Body.Close()
+			cancel()
+			return nil, dialError(dialCtx, err)
+		}
+		frame = strings.TrimSpace(frame)
+		if frame == "o" {
+			break
+		}
+		if !strings.HasPrefix(frame, "h") {
+			resp.Body.Close()
+			cancel()
+			return nil, fmt.Errorf("%w: %q", ErrSockJSUnexpectedFrame, frame)
+		}
+	}
+	if !stop() {
+		resp.Body.Close()
+		return nil, dialCtx.Err()
+	}
+
+	switch transport {
+	case SockJSXHRStreaming:
+		go c.stream(resp.Body, reader)
+	default:
+		resp.Body.Close()
+		go c.poll()
+	}
+	return c, nil
+}
+
+// dialError reports error of dialCtx instead of err it caused, request
+// fails with context.Canceled when dialCtx is done.
+func dialError(dialCtx context.Context, err error) error {
+	if dialCtx.Err() != nil {
+		return dialCtx.Err()
+	}
+	return err
+}
+
+func (c *sockjsConnection) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.sessionURL+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Wrong status code while connecting to server: '%d'", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// stream reads frames from xhr-streaming responses. Server ends response
+// from time to time, new one is requested for the same session then.
+func (c *sockjsConnection) stream(body io.ReadCloser, reader *bufio.Reader) {
+	for {
+		err := c.readFrames(reader)
+		body.Close()
+		if err != io.EOF {
+			c.fail(err)
+			return
+		}
+		resp, err := c.post(c.ctx, SockJSXHRStreaming, nil)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		body = resp.Body
+		reader = bufio.NewReader(body)
+	}
+}
+
+// poll requests frames with xhr-polling one response after another.
+func (c *sockjsConnection) poll() {
+	for {
+		resp, err := c.post(c.ctx, SockJSXHRPolling, nil)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		err = c.readFrames(bufio.NewReader(resp.Body))
+		resp.Body.Close()
+		if err != io.EOF {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// readFrames handles frames until reader is exhausted, it returns io.EOF
+// then or error which must stop the connection.
+func (c *sockjsConnection) readFrames(reader *bufio.Reader) error {
+	for {
+		frame, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		err = c.handleFrame(strings.TrimSpace(frame))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *sockjsConnection) handleFrame(frame string) error {
+	if frame == "" {
+		return nil
+	}
+	switch frame[0] {
+	case 'o', 'h':
+		return nil
+	case 'a':
+		var messages []string
+		err := json.Unmarshal([]byte(frame[1:]), &messages)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			select {
+			case c.messages <- []byte(m):
+			case <-c.ctx.Done():
+				return ErrSockJSClosed
+			}
+		}
+		return nil
+	case 'c':
+		return fmt.Errorf("%w: %s", ErrSockJSClosed, frame[1:])
+	default:
+		return fmt.Errorf("%w: %q", ErrSockJSUnexpectedFrame, frame)
+	}
+}
+
+func (c *sockjsConnection) fail(err error) {
+	c.errOnce.Do(func() {
+		if c.ctx.Err() != nil {
+			err = ErrSockJSClosed
+		}
+		c.err = err
+		close(c.done)
+	})
+}
+
+func (c *sockjsConnection) Close() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.fail(ErrSockJSClosed)
+	})
+}
+
+func (c *sockjsConnection) WriteMessage(msg []byte) error {
+	body, err := json.Marshal([]string{string(msg)})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, c.writeTimeout)
+	defer cancel()
+	resp, err := c.post(ctx, "xhr_send", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *sockjsConnection) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-c.messages:
+		return msg, nil
+	case <-c.done:
+		// Deliver messages received before connection stopped.
+		select {
+		case msg := <-c.messages:
+			return msg, nil
+		default:
+		}
+		return nil, c.err
+	}
+}
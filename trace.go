@@ -0,0 +1,48 @@
+package centrifuge
+
+import (
+	"context"
+
+	"github.com/shilkin/centrifugo/libcentrifugo"
+)
+
+// Tracer traces commands sent to server, package centrifugeotel has
+// OpenTelemetry adapter. Ping commands are not traced.
+type Tracer interface {
+	// StartCommand is called before command is sent. ctx is context passed
+	// to client method, background for commands client sends on its own.
+	// channel is empty for commands without channel. Returned function is
+	// called once with error of command when it is done.
+	StartCommand(ctx context.Context, method, channel string) func(error)
+}
+
+// traceCommand starts span of cmd when Config.Tracer is set. Returned
+// function ends it with error of waiting for reply r.
+func (c *centrifugeImpl) traceCommand(ctx context.Context, cmd clientCommand) func(response, error) {
+	if c.config.Tracer == nil || cmd.Method == "ping" {
+		return func(response, error) {}
+	}
+	end := c.config.Tracer.StartCommand(ctx, cmd.Method, commandChannel(cmd))
+	return func(r response, err error) {
+		if err == nil && r.Error != "" {
+			err = newServerError(r)
+		}
+		end(err)
+	}
+}
+
+func commandChannel(cmd clientCommand) string {
+	switch params := cmd.Params.(type) {
+	case *libcentrifugo.SubscribeClientCommand:
+		return string(params.Channel)
+	case *libcentrifugo.UnsubscribeClientCommand:
+		return string(params.Channel)
+	case *libcentrifugo.PublishClientCommand:
+		return string(params.Channel)
+	case *libcentrifugo.HistoryClientCommand:
+		return string(params.Channel)
+	case *libcentrifugo.PresenceClientCommand:
+		return string(params.Channel)
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package centrifuge
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/shilkin/centrifugo/libcentrifugo"
+)
+
+// TypedMessageHandler receives message data decoded from JSON into T. msg
+// carries message metadata such as UID, Info and Timestamp.
+type TypedMessageHandler[T any] func(sub *TypedSub[T], data T, msg libcentrifugo.Message) error
+
+// DecodeErrorHandler is called when message data can not be decoded.
+type DecodeErrorHandler func(sub *Sub, msg libcentrifugo.Message, err error)
+
+// TypedSubEventHandler is SubEventHandler for TypedSub. Handlers other
+// than OnMessage are taken from embedded SubEventHandler, its OnMessage is
+// ignored. Messages which can not be decoded are passed to OnDecodeError
+// instead of OnMessage.
+type TypedSubEventHandler[T any] struct {
+	SubEventHandler
+	OnMessage     TypedMessageHandler[T]
+	OnDecodeError DecodeErrorHandler
+}
+
+// TypedSub is a subscription with message data of type T.
+type TypedSub[T any] struct {
+	*Sub
+}
+
+// SubscribeTyped subscribes on channel and decodes message data into T.
+func SubscribeTyped[T any](c Centrifuge, channel string, events *TypedSubEventHandler[T]) (*TypedSub[T], error) {
+	return SubscribeTypedContext(context.Background(), c, channel, events)
+}
+
+// SubscribeTypedContext is SubscribeTyped with ctx for subscribe request.
+func SubscribeTypedContext[T any](ctx context.Context, c Centrifuge, channel string, events *TypedSubEventHandler[T]) (*TypedSub[T], error) {
+	sub, err := c.SubscribeContext(ctx, channel, events.subEventHandler())
+	if err != nil {
+		return nil, err
+	}
+	return &TypedSub[T]{Sub: sub}, nil
+}
+
+func (h *TypedSubEventHandler[T]) subEventHandler() *SubEventHandler {
+	if h == nil {
+		return nil
+	}
+	events := h.SubEventHandler
+	events.OnMessage = h.handleMessage
+	return &events
+}
+
+func (h *TypedSubEventHandler[T]) handleMessage(sub *Sub, msg libcentrifugo.Message) error {
+	var data T
+	if msg.Data != nil {
+		err := json.Unmarshal(*msg.Data, &data)
+		if err != nil {
+			if h.OnDecodeError != nil {
+				h.OnDecodeError(sub, msg, err)
+				return nil
+			}
+			return err
+		}
+	}
+	if h.OnMessage == nil {
+		return nil
+	}
+	return h.OnMessage(&TypedSub[T]{Sub: sub}, data, msg)
+}
+
+// Publish encodes data to JSON and publishes it into channel.
+func (s *TypedSub[T]) Publish(data T) error {
+	return s.PublishContext(context.Background(), data)
+}
+
+// PublishContext is Publish with ctx for publish request.
+func (s *TypedSub[T]) PublishContext(ctx context.Context, data T) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.Sub.PublishContext(ctx, b)
+}
+
+// PublishAsync encodes data to JSON and publishes it without waiting for
+// reply, see Sub.PublishAsync.
+func (s *TypedSub[T]) PublishAsync(data T, done func(error)) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		if done != nil {
+			go done(err)
+		}
+		return
+	}
+	s.Sub.PublishAsync(b, done)
+}